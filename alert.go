@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"sunny-lsp/analysis"
+	"sunny-lsp/lsp"
+	"time"
+)
+
+// compilerAlertInterval is how long the user is left alone after being
+// told the compiler is broken, so a bad setup doesn't nag on every
+// keystroke.
+const compilerAlertInterval = 5 * time.Minute
+
+const (
+    actionRetry = "Retry"
+    actionOpenLog = "Open log"
+)
+
+// compilerFailed tells the user the compiler could not be run. Only
+// compiler errors are shown, anything else is just logged. At most one
+// message is open at a time and they are rate-limited. Each failure is
+// logged below Warn, which would reach the client past the rate limit.
+func (s *session) compilerFailed(uri string, err error) {
+    var compilerErr *analysis.CompilerError
+    if !errors.As(err, &compilerErr) {
+        s.logger.Info("Could not compile", "uri", uri, "err", err)
+        return
+    }
+    s.logger.Info("Compiler failed", "uri", uri, "err", err)
+    if compilerErr.Kind == analysis.CompilerNotFound {
+        s.setCompilerMissing(true)
+    }
+
+    s.mu.Lock()
+    if s.alertOpen || time.Since(s.alertShown) < compilerAlertInterval {
+        s.mu.Unlock()
+        return
+    }
+    s.alertOpen = true
+    s.alertShown = time.Now()
+    logFile := s.baseConfig.LogFile
+    s.mu.Unlock()
+    s.logger.Warn("Compiler failed", "uri", uri, "err", err)
+
+    params := lsp.ShowMessageRequestParams{
+        Type: lsp.MessageTypeError,
+        Message: "sunny-lsp: " + compilerErr.Error(),
+        Actions: []lsp.MessageActionItem{{Title: actionRetry}},
+    }
+    logURI := logFileURI(logFile)
+    if logURI != "" && s.client.Window.ShowDocument != nil && s.client.Window.ShowDocument.Support {
+        params.Actions = append(params.Actions, lsp.MessageActionItem{Title: actionOpenLog})
+    }
+
+    // the answer arrives on the read loop, so wait for it elsewhere
+    go func() {
+        var action *lsp.MessageActionItem
+        err := s.conn.Call(s.ctx, "window/showMessageRequest", params, &action)
+
+        s.mu.Lock()
+        s.alertOpen = false
+        s.mu.Unlock()
+        if err != nil || action == nil {
+            return
+        }
+
+        switch action.Title {
+        case actionRetry:
+            s.resetCompilerAlert()
+            for _, uri := range s.state.DocumentURIs() {
+                s.queueDiagnostics(uri)
+            }
+        case actionOpenLog:
+            var result lsp.ShowDocumentResult
+            showErr := s.conn.Call(s.ctx, "window/showDocument", lsp.ShowDocumentParams{
+                URI: logURI,
+                TakeFocus: true,
+            }, &result)
+            if showErr != nil || !result.Success {
+                s.logger.Info("Could not open log", "uri", logURI, "err", showErr)
+            }
+        }
+    }()
+}
+
+// compilerRecovered turns the features that need the compiler back on.
+// It doesn't lift the rate limit: a compiler that only crashes on some
+// half-typed input succeeds in between, and would alert on every crash.
+func (s *session) compilerRecovered() {
+    s.setCompilerMissing(false)
+}
+
+// resetCompilerAlert lets the next failure be shown straight away, after
+// the user asked to retry or the compiler was changed.
+func (s *session) resetCompilerAlert() {
+    s.mu.Lock()
+    s.alertShown = time.Time{}
+    s.mu.Unlock()
+}
+
+// setCompilerMissing records whether the compiler can be found, turning
+// the features that need it off and on.
+func (s *session) setCompilerMissing(missing bool) {
+    s.mu.Lock()
+    changed := s.compilerMissing != missing
+    s.compilerMissing = missing
+    s.mu.Unlock()
+    if changed {
+        s.updateRegistrations()
+    }
+}
+
+// logFileURI returns the URI of the log, or "" if it doesn't go to a
+// file.
+func logFileURI(filename string) string {
+    if filename == "" || filename == "none" || filename == "stderr" {
+        return ""
+    }
+    path, err := filepath.Abs(filename)
+    if err != nil {
+        return ""
+    }
+    return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
@@ -2,7 +2,7 @@ package analysis
 
 import "sunny-lsp/lsp"
 
-func (s *State) TextCodeAction(id int, uri string, action_range lsp.Range) lsp.CodeActionResponse {
+func (s *State) TextCodeAction(uri string, action_range lsp.Range) []lsp.CodeAction {
     actions := []lsp.CodeAction{}
 
     funcSnippet := `func FOO() {
@@ -55,11 +55,5 @@ for (mut i32 i := 0; i < n; i := i + 1) {
         },
     })
 
-    return lsp.CodeActionResponse{
-        Response: lsp.Response{
-            RPC: "2.0",
-            ID:  &id,
-        },
-        Result: actions,
-    }
+    return actions
 }
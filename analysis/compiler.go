@@ -0,0 +1,163 @@
+package analysis
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Compiler exports the symbols, AST and diagnostics of a source file as
+// JSON, in the format read into CompilerContext.
+type Compiler interface {
+    Export(ctx context.Context, filename string) ([]byte, error)
+}
+
+type CompilerErrorKind int
+
+const (
+    // the binary does not exist or can't be executed
+    CompilerNotFound CompilerErrorKind = iota
+    // killed by a signal, e.g. it crashed
+    CompilerSignaled
+    // exited with a non-zero status
+    CompilerExited
+    // ran fine but its output could not be read
+    CompilerBadOutput
+    // still running when its time was up
+    CompilerTimedOut
+)
+
+// CompilerError is returned when the compiler itself failed, as opposed
+// to reporting diagnostics for the source. It is what users have to fix
+// in their setup, so the message says what went wrong in plain words.
+type CompilerError struct {
+    Kind CompilerErrorKind
+    Path string
+    // exit status or signal, for CompilerExited and CompilerSignaled
+    ExitCode int
+    Signal syscall.Signal
+    // the limit it ran into, for CompilerTimedOut
+    Timeout time.Duration
+    // what the compiler wrote to stderr, if anything
+    Stderr string
+    Err error
+}
+
+func (e *CompilerError) Error() string {
+    var message string
+    switch e.Kind {
+    case CompilerNotFound:
+        message = fmt.Sprintf("compiler not found at %s", e.Path)
+        if errors.Is(e.Err, fs.ErrPermission) {
+            message = fmt.Sprintf("compiler at %s is not executable", e.Path)
+        }
+    case CompilerSignaled:
+        message = fmt.Sprintf("compiler %s exited with signal: %s", e.Path, e.Signal)
+    case CompilerExited:
+        message = fmt.Sprintf("compiler %s exited with status %d", e.Path, e.ExitCode)
+    case CompilerBadOutput:
+        message = fmt.Sprintf("compiler %s produced invalid output: %v", e.Path, e.Err)
+    case CompilerTimedOut:
+        message = fmt.Sprintf("compiler %s did not finish within %s", e.Path, e.Timeout)
+    }
+    if e.Stderr != "" {
+        message += "\n" + e.Stderr
+    }
+    return message
+}
+
+func (e *CompilerError) Unwrap() error {
+    return e.Err
+}
+
+// ExecCompiler runs the compiler binary at Path with --export-json.
+type ExecCompiler struct {
+    Path string
+    // how long a compile may run before it is killed,
+    // DefaultCompilerTimeout if zero
+    Timeout time.Duration
+}
+
+// DefaultCompilerTimeout is far longer than any compile should take; it
+// is there so a hung compiler can't hold a session open forever.
+const DefaultCompilerTimeout = 30 * time.Second
+
+// compilerWaitDelay is how long a cancelled compile may keep its output
+// open after it is killed, e.g. through a child that outlived it.
+const compilerWaitDelay = time.Second
+
+func (c ExecCompiler) Export(ctx context.Context, filename string) ([]byte, error) {
+    timeout := c.Timeout
+    if timeout == 0 {
+        timeout = DefaultCompilerTimeout
+    }
+    runCtx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(runCtx, c.Path, "--export-json", filename)
+    // the compiler may be a wrapper script; killing only the script would
+    // leave its children running and holding stdout open
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error {
+        return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+    }
+    cmd.WaitDelay = compilerWaitDelay
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr  // stderr separately
+    output, err := cmd.Output()  // stdout only
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if runCtx.Err() != nil {
+		return nil, &CompilerError{Kind: CompilerTimedOut, Path: c.Path, Timeout: timeout, Err: runCtx.Err()}
+	}
+	if err != nil {
+		return nil, c.error(err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// error classifies a failed run of the compiler.
+func (c ExecCompiler) error(err error, stderr string) error {
+    compilerErr := &CompilerError{Path: c.Path, Stderr: stderr, Err: err}
+
+    var exitErr *exec.ExitError
+    switch {
+    case errors.As(err, &exitErr):
+        status, ok := exitErr.Sys().(syscall.WaitStatus)
+        if ok && status.Signaled() {
+            compilerErr.Kind = CompilerSignaled
+            compilerErr.Signal = status.Signal()
+        } else {
+            compilerErr.Kind = CompilerExited
+            compilerErr.ExitCode = exitErr.ExitCode()
+        }
+    case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+        compilerErr.Kind = CompilerNotFound
+    default:
+        return fmt.Errorf("running compiler %s: %w", c.Path, err)
+    }
+    return compilerErr
+}
+
+// StubCompiler returns the same output for every file. It stands in for
+// the real compiler when it is not available, e.g. when replaying traces.
+type StubCompiler struct {
+    Output []byte
+}
+
+const emptyExport = `{"symbols":[],"ast":[],"diagnostics":[]}`
+
+func (c StubCompiler) Export(ctx context.Context, filename string) ([]byte, error) {
+    if c.Output == nil {
+        return []byte(emptyExport), nil
+    }
+    return c.Output, nil
+}
@@ -0,0 +1,50 @@
+package analysis_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sunny-lsp/analysis"
+	"testing"
+	"time"
+)
+
+// A cancelled compile must stop a wrapper script's children too, not wait
+// for them to close stdout.
+func TestExecCompilerCancel(t *testing.T) {
+    script := filepath.Join(t.TempDir(), "compile.sh")
+    if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 5\necho '{}'\n"), 0755); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    _, err := analysis.ExecCompiler{Path: script}.Export(ctx, "main.sunny")
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("Expected DeadlineExceeded, Actual %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 2 * time.Second {
+        t.Fatalf("Expected the compile to stop at once, Actual %s", elapsed)
+    }
+}
+
+// A compiler that hangs is killed and reported, it must not keep the
+// session waiting.
+func TestExecCompilerTimeout(t *testing.T) {
+    script := filepath.Join(t.TempDir(), "compile.sh")
+    if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 5\necho '{}'\n"), 0755); err != nil {
+        t.Fatal(err)
+    }
+
+    start := time.Now()
+    _, err := analysis.ExecCompiler{Path: script, Timeout: 100 * time.Millisecond}.Export(context.Background(), "main.sunny")
+    var compilerErr *analysis.CompilerError
+    if !errors.As(err, &compilerErr) || compilerErr.Kind != analysis.CompilerTimedOut {
+        t.Fatalf("Expected CompilerTimedOut, Actual %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 2 * time.Second {
+        t.Fatalf("Expected the compile to stop at the timeout, Actual %s", elapsed)
+    }
+}
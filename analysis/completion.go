@@ -2,7 +2,7 @@ package analysis
 
 import "sunny-lsp/lsp"
 
-func (s *State) Completion(id int, uri string) lsp.CompletionResponse {
+func (s *State) Completion(uri string) []lsp.CompletionItem {
     keywordCompletions := []lsp.CompletionItem{
         {Label: "func", Detail: "Function declaration", Documentation: "Define a new function"},
         {Label: "mut", Detail: "Mutable declaration", Documentation: "Declare a mutable variable"},
@@ -37,11 +37,53 @@ func (s *State) Completion(id int, uri string) lsp.CompletionResponse {
         {Label: "u0", Detail: "Void type", Documentation: "Absence of type"},
     }
 
-    return lsp.CompletionResponse{
-        Response: lsp.Response{
-            RPC: "2.0",
-            ID:  &id,
-        },
-        Result: append(keywordCompletions, typeCompletions...),
+    for i := range keywordCompletions {
+        keywordCompletions[i].Kind = lsp.CompletionItemKindKeyword
     }
+    for i := range typeCompletions {
+        typeCompletions[i].Kind = lsp.CompletionItemKindTypeParameter
+    }
+
+    items := append(keywordCompletions, typeCompletions...)
+    if s.Client.Snippets() {
+        items = append(items, snippetCompletions...)
+    }
+
+    return items
+}
+
+// only offered to clients that can expand snippets
+var snippetCompletions = []lsp.CompletionItem{
+    {
+        Label: "func",
+        Kind: lsp.CompletionItemKindSnippet,
+        Detail: "Function template",
+        Documentation: "Define a new function",
+        InsertText: "func ${1:name}(${2}) {\n\t$0\n}",
+        InsertTextFormat: lsp.InsertTextFormatSnippet,
+    },
+    {
+        Label: "for",
+        Kind: lsp.CompletionItemKindSnippet,
+        Detail: "For loop template",
+        Documentation: "Iterate with a counter",
+        InsertText: "for (mut i32 ${1:i} := 0; $1 < ${2:n}; $1 := $1 + 1) {\n\t$0\n}",
+        InsertTextFormat: lsp.InsertTextFormatSnippet,
+    },
+    {
+        Label: "while",
+        Kind: lsp.CompletionItemKindSnippet,
+        Detail: "While loop template",
+        Documentation: "Loop while a condition holds",
+        InsertText: "while (${1:true}) {\n\t$0\n}",
+        InsertTextFormat: lsp.InsertTextFormatSnippet,
+    },
+    {
+        Label: "if",
+        Kind: lsp.CompletionItemKindSnippet,
+        Detail: "If-else template",
+        Documentation: "Conditional execution with an else branch",
+        InsertText: "if (${1:true}) {\n\t$2\n} else {\n\t$0\n}",
+        InsertTextFormat: lsp.InsertTextFormatSnippet,
+    },
 }
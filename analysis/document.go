@@ -0,0 +1,179 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sunny-lsp/lsp"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Document is the text of an open file and the byte offset of the start
+// of each line, so positions can be turned into offsets and back without
+// scanning the whole text.
+//
+// Characters in positions count in the encoding negotiated with the
+// client, one of the lsp.PositionEncoding kinds. The compiler counts
+// bytes; FromBytes converts its positions.
+type Document struct {
+    text string
+    encoding string
+    // the client's version of the text, increasing with every change
+    version int
+    // lines[i] is the offset of line i; there is always at least one.
+    // Changes replace the slice instead of editing it, so a copy of a
+    // Document doesn't see them.
+    lines []int
+}
+
+func NewDocument(text, encoding string) *Document {
+    return &Document{
+        text: text,
+        encoding: encoding,
+        lines: lineStarts(text, 0, []int{0}),
+    }
+}
+
+// lineStarts appends the offset after every newline in text, shifted by
+// base, to lines.
+func lineStarts(text string, base int, lines []int) []int {
+    for i := 0; i < len(text); i++ {
+        if text[i] == '\n' {
+            lines = append(lines, base + i + 1)
+        }
+    }
+    return lines
+}
+
+func (d *Document) Text() string {
+    return d.text
+}
+
+func (d *Document) Version() int {
+    return d.version
+}
+
+// LineCount is the number of lines, counting the one after a final newline.
+func (d *Document) LineCount() int {
+    return len(d.lines)
+}
+
+// line returns the text of line n without its line ending.
+func (d *Document) line(n int) string {
+    end := len(d.text)
+    if n + 1 < len(d.lines) {
+        end = d.lines[n + 1] - 1
+    }
+    return strings.TrimSuffix(d.text[d.lines[n]:end], "\r")
+}
+
+// Offset returns the byte offset of pos. A character past the end of its
+// line means the end of the line, as the protocol asks.
+func (d *Document) Offset(pos lsp.Position) (int, error) {
+    if pos.Line < 0 || pos.Line >= len(d.lines) {
+        return 0, fmt.Errorf("line %d is outside the document of %d lines", pos.Line, len(d.lines))
+    }
+    if pos.Character < 0 {
+        return 0, fmt.Errorf("negative character %d", pos.Character)
+    }
+    return d.lines[pos.Line] + d.byteIndex(d.line(pos.Line), pos.Character), nil
+}
+
+// Position returns the position of a byte offset, which is clamped to the
+// text.
+func (d *Document) Position(offset int) lsp.Position {
+    offset = max(0, min(offset, len(d.text)))
+    // the last line starting at or before offset
+    n := sort.Search(len(d.lines), func(i int) bool { return d.lines[i] > offset }) - 1
+    return lsp.Position{Line: n, Character: d.units(d.text[d.lines[n]:offset])}
+}
+
+// FromBytes converts a position whose character counts bytes, as the
+// compiler's do, to the document's encoding. Lines the document doesn't
+// have are left alone.
+func (d *Document) FromBytes(pos lsp.Position) lsp.Position {
+    if pos.Line < 0 || pos.Line >= len(d.lines) || pos.Character < 0 {
+        return pos
+    }
+    line := d.line(pos.Line)
+    return lsp.Position{Line: pos.Line, Character: d.units(line[:min(pos.Character, len(line))])}
+}
+
+// units is the length of s in the document's encoding.
+func (d *Document) units(s string) int {
+    switch d.encoding {
+    case lsp.PositionEncodingUTF8:
+        return len(s)
+    case lsp.PositionEncodingUTF32:
+        return utf8.RuneCountInString(s)
+    }
+    n := 0
+    for _, r := range s {
+        n += utf16.RuneLen(r)
+    }
+    return n
+}
+
+// byteIndex is the byte offset in line after n units of the document's
+// encoding, or the end of the line. It never splits a character.
+func (d *Document) byteIndex(line string, n int) int {
+    units := 0
+    for i := 0; i < len(line); {
+        if units >= n {
+            return i
+        }
+        r, size := utf8.DecodeRuneInString(line[i:])
+        switch d.encoding {
+        case lsp.PositionEncodingUTF8:
+            units += size
+        case lsp.PositionEncodingUTF32:
+            units++
+        default:
+            units += utf16.RuneLen(r)
+        }
+        i += size
+    }
+    return len(line)
+}
+
+// Apply makes one change to the text. A change without a range replaces
+// all of it.
+//
+// Every edit copies the text and the line offsets, so it costs O(n) in
+// the size of the document even for a single keystroke. That is a plain
+// copy of at most a few hundred kilobytes for source files, and it keeps
+// copies of a Document immutable without a rope or piece table.
+func (d *Document) Apply(change lsp.TextDocumentContentChangeEvent) error {
+    if change.Range == nil {
+        d.text, d.lines = change.Text, lineStarts(change.Text, 0, []int{0})
+        return nil
+    }
+
+    start, err := d.Offset(change.Range.Start)
+    if err != nil {
+        return err
+    }
+    end, err := d.Offset(change.Range.End)
+    if err != nil {
+        return err
+    }
+    if end < start {
+        return fmt.Errorf("range ends before it starts")
+    }
+
+    startLine, endLine := change.Range.Start.Line, change.Range.End.Line
+    delta := len(change.Text) - (end - start)
+
+    // lines up to the start are untouched, those after the end move by delta
+    lines := make([]int, 0, len(d.lines) + strings.Count(change.Text, "\n"))
+    lines = append(lines, d.lines[:startLine + 1]...)
+    lines = lineStarts(change.Text, start, lines)
+    for _, offset := range d.lines[endLine + 1:] {
+        lines = append(lines, offset + delta)
+    }
+
+    d.text = d.text[:start] + change.Text + d.text[end:]
+    d.lines = lines
+    return nil
+}
@@ -0,0 +1,140 @@
+package analysis_test
+
+import (
+	"math/rand"
+	"strings"
+	"sunny-lsp/analysis"
+	"sunny-lsp/lsp"
+	"testing"
+	"unicode/utf8"
+)
+
+func change(startLine, startChar, endLine, endChar int, text string) lsp.TextDocumentContentChangeEvent {
+    return lsp.TextDocumentContentChangeEvent{
+        Range: &lsp.Range{
+            Start: lsp.Position{Line: startLine, Character: startChar},
+            End: lsp.Position{Line: endLine, Character: endChar},
+        },
+        Text: text,
+    }
+}
+
+func TestDocumentApply(t *testing.T) {
+    doc := analysis.NewDocument("func main() {\n    print(1);\n}\n", lsp.PositionEncodingUTF16)
+
+    edits := []struct {
+        change lsp.TextDocumentContentChangeEvent
+        expected string
+    }{
+        {change(1, 10, 1, 11, "42"), "func main() {\n    print(42);\n}\n"},
+        {change(0, 13, 0, 13, "\n    mut i32 x := 0;"), "func main() {\n    mut i32 x := 0;\n    print(42);\n}\n"},
+        {change(1, 0, 3, 0, ""), "func main() {\n}\n"},
+        // past the end of the line means the end of the line
+        {change(0, 99, 0, 99, " // entry"), "func main() { // entry\n}\n"},
+        {lsp.TextDocumentContentChangeEvent{Text: "x"}, "x"},
+    }
+    for i, edit := range edits {
+        if err := doc.Apply(edit.change); err != nil {
+            t.Fatalf("edit %d: %v", i, err)
+        }
+        if doc.Text() != edit.expected {
+            t.Fatalf("edit %d: Expected %q, Actual %q", i, edit.expected, doc.Text())
+        }
+    }
+
+    if err := doc.Apply(change(5, 0, 5, 0, "y")); err == nil {
+        t.Fatalf("Expected an error for a line outside the document")
+    }
+}
+
+// Characters count UTF-16 code units: é is one, 𝄞 is two.
+func TestDocumentUTF16(t *testing.T) {
+    doc := analysis.NewDocument("é𝄞x\r\nok", lsp.PositionEncodingUTF16)
+
+    offset, err := doc.Offset(lsp.Position{Line: 0, Character: 3})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if offset != len("é𝄞") {
+        t.Fatalf("Expected %d, Actual %d", len("é𝄞"), offset)
+    }
+    if pos := doc.Position(offset); pos != (lsp.Position{Line: 0, Character: 3}) {
+        t.Fatalf("Expected 0:3, Actual %d:%d", pos.Line, pos.Character)
+    }
+
+    // \r is part of the line ending, not the line
+    if offset, _ := doc.Offset(lsp.Position{Line: 0, Character: 99}); offset != len("é𝄞x") {
+        t.Fatalf("Expected the end of the line, Actual offset %d", offset)
+    }
+    if pos := doc.Position(len(doc.Text())); pos != (lsp.Position{Line: 1, Character: 2}) {
+        t.Fatalf("Expected 1:2, Actual %d:%d", pos.Line, pos.Character)
+    }
+}
+
+// Random edits must leave the same text and index as building the
+// document from scratch.
+func TestDocumentRandomEdits(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    pieces := []string{"", "a", "bc", "\n", "x\ny", "\n\n", "é", "𝄞"}
+    doc := analysis.NewDocument("one\ntwo\nthree", lsp.PositionEncodingUTF16)
+
+    for i := 0; i < 2000; i++ {
+        text := doc.Text()
+        a, b := rng.Intn(len(text) + 1), rng.Intn(len(text) + 1)
+        if a > b {
+            a, b = b, a
+        }
+        // only cut on rune boundaries
+        for a < len(text) && !utf8.RuneStart(text[a]) {
+            a--
+        }
+        for b < len(text) && !utf8.RuneStart(text[b]) {
+            b--
+        }
+        insert := pieces[rng.Intn(len(pieces))]
+
+        edit := lsp.TextDocumentContentChangeEvent{
+            Range: &lsp.Range{Start: doc.Position(a), End: doc.Position(b)},
+            Text: insert,
+        }
+        if err := doc.Apply(edit); err != nil {
+            t.Fatalf("edit %d: %v", i, err)
+        }
+
+        expected := text[:a] + insert + text[b:]
+        if doc.Text() != expected {
+            t.Fatalf("edit %d: Expected %q, Actual %q", i, expected, doc.Text())
+        }
+        fresh := analysis.NewDocument(expected, lsp.PositionEncodingUTF16)
+        if doc.LineCount() != strings.Count(expected, "\n") + 1 {
+            t.Fatalf("edit %d: Expected %d lines, Actual %d", i, fresh.LineCount(), doc.LineCount())
+        }
+        for _, offset := range []int{0, len(expected) / 2, len(expected)} {
+            if doc.Position(offset) != fresh.Position(offset) {
+                t.Fatalf("edit %d: index differs at offset %d", i, offset)
+            }
+        }
+    }
+}
+
+// The compiler's byte columns read the same in every encoding once
+// converted, and convert back to the same offset.
+func TestDocumentEncodings(t *testing.T) {
+    text := "s := \"é𝄞\"; x"
+    column := strings.Index(text, "x")
+    expected := map[string]int{
+        lsp.PositionEncodingUTF8: column,
+        lsp.PositionEncodingUTF16: column - 1 - 2,
+        lsp.PositionEncodingUTF32: column - 1 - 3,
+    }
+    for encoding, character := range expected {
+        doc := analysis.NewDocument(text, encoding)
+        pos := doc.FromBytes(lsp.Position{Line: 0, Character: column})
+        if pos.Character != character {
+            t.Fatalf("%s: Expected %d, Actual %d", encoding, character, pos.Character)
+        }
+        if offset, _ := doc.Offset(pos); offset != column {
+            t.Fatalf("%s: Expected offset %d, Actual %d", encoding, column, offset)
+        }
+    }
+}
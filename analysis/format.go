@@ -0,0 +1,55 @@
+package analysis
+
+import (
+	"strings"
+	"sunny-lsp/lsp"
+)
+
+// Format returns the edits that trim trailing whitespace from every line
+// of uri and end it with exactly one newline. It is all the formatting
+// there is until the compiler can print the AST back.
+func (s *State) Format(uri string) []lsp.TextEdit {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return nil
+    }
+
+    // everything blank after the last line with text is replaced by one
+    // newline
+    text := doc.Text()
+    end := len(strings.TrimRight(text, " \t\r\n"))
+    fixEnd := end > 0 && text[end:] != "\n" && text[end:] != "\r\n"
+
+    edits := []lsp.TextEdit{}
+    for n := 0; n < doc.LineCount() - 1; n++ {
+        line := doc.line(n)
+        trimmed := strings.TrimRight(line, " \t")
+        start := doc.lines[n] + len(trimmed)
+        if fixEnd && start >= end {
+            // edits must not overlap the one at the end
+            break
+        }
+        if len(trimmed) < len(line) {
+            edits = append(edits, lsp.TextEdit{
+                Range: lsp.Range{
+                    Start: doc.Position(start),
+                    End: doc.Position(doc.lines[n] + len(line)),
+                },
+            })
+        }
+    }
+
+    if fixEnd {
+        newline := "\n"
+        if strings.Contains(text, "\r\n") {
+            newline = "\r\n"
+        }
+        edits = append(edits, lsp.TextEdit{
+            Range: lsp.Range{Start: doc.Position(end), End: doc.Position(len(text))},
+            NewText: newline,
+        })
+    }
+    return edits
+}
@@ -0,0 +1,37 @@
+package analysis_test
+
+import (
+	"sunny-lsp/analysis"
+	"sunny-lsp/lsp"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+    tests := []struct {
+        text string
+        expected string
+    }{
+        {"func main() {  \n\tprint(1);\t\n}", "func main() {\n\tprint(1);\n}\n"},
+        {"x;  \n  \n\n", "x;\n"},
+        {"x;\r\ny; \r\n\r\n", "x;\r\ny;\r\n"},
+        {"x;\n", "x;\n"},
+        {"", ""},
+    }
+    for _, test := range tests {
+        state := analysis.NewState(nil, nil)
+        state.OpenDocument("file:///a.sunny", test.text, 1)
+
+        // applied back to front, as they may not overlap
+        edits := state.Format("file:///a.sunny")
+        doc := analysis.NewDocument(test.text, lsp.PositionEncodingUTF16)
+        for i := len(edits) - 1; i >= 0; i-- {
+            err := doc.Apply(lsp.TextDocumentContentChangeEvent{Range: &edits[i].Range, Text: edits[i].NewText})
+            if err != nil {
+                t.Fatalf("%q: %v", test.text, err)
+            }
+        }
+        if doc.Text() != test.expected {
+            t.Fatalf("%q: Expected %q, Actual %q", test.text, test.expected, doc.Text())
+        }
+    }
+}
@@ -0,0 +1,72 @@
+package analysis
+
+import (
+	"strings"
+	"sunny-lsp/lsp"
+)
+
+// QuickDiagnostics checks uri without the compiler, for while the user
+// types: brackets that don't match and strings that aren't closed. It
+// returns the version checked, and false if uri is not open.
+func (s *State) QuickDiagnostics(uri string) ([]lsp.Diagnostic, int, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return nil, 0, false
+    }
+    return checkBrackets(doc), doc.Version(), true
+}
+
+var closing = map[byte]byte{')': '(', ']': '[', '}': '{'}
+
+func checkBrackets(doc *Document) []lsp.Diagnostic {
+    diagnostics := []lsp.Diagnostic{}
+    report := func(start, end int, message string) {
+        diagnostics = append(diagnostics, lsp.Diagnostic{
+            Range: lsp.Range{Start: doc.Position(start), End: doc.Position(end)},
+            Severity: lsp.DiagnosticError,
+            Source: "sunny-lsp",
+            Message: message,
+        })
+    }
+
+    text := doc.Text()
+    var open []int
+    for i := 0; i < len(text); i++ {
+        switch c := text[i]; c {
+        case '"':
+            end := i + 1
+            for end < len(text) && text[end] != '"' && text[end] != '\n' {
+                if text[end] == '\\' {
+                    end++
+                }
+                end++
+            }
+            if end >= len(text) || text[end] != '"' {
+                report(i, min(end, len(text)), "unterminated string")
+            }
+            i = end
+        case '/':
+            if strings.HasPrefix(text[i:], "//") {
+                if end := strings.IndexByte(text[i:], '\n'); end >= 0 {
+                    i += end
+                } else {
+                    i = len(text)
+                }
+            }
+        case '(', '[', '{':
+            open = append(open, i)
+        case ')', ']', '}':
+            if len(open) == 0 || text[open[len(open) - 1]] != closing[c] {
+                report(i, i + 1, "unexpected '" + string(c) + "'")
+                continue
+            }
+            open = open[:len(open) - 1]
+        }
+    }
+    for _, i := range open {
+        report(i, i + 1, "'" + string(text[i]) + "' is never closed")
+    }
+    return diagnostics
+}
@@ -1,198 +1,258 @@
 package analysis
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
+	"slices"
 	"strings"
 	"sunny-lsp/lsp"
 )
 
-func NewState(logger *log.Logger) State {
-    return State {
-        Documents: map[string]string{},
+func NewState(logger *slog.Logger, compiler Compiler) *State {
+    return &State {
+        Documents: map[string]*Document{},
         Logger: logger,
+        Encoding: lsp.PositionEncodingUTF16,
+        compiler: compiler,
     }
 }
 
-const (
-	CompilerPath = "/Users/mdurcan/personal/git_projects/tools/lang-dev/sunny-lang/compile.out"
-)
+// SetCompiler switches the compiler used from the next compile on.
+func (s *State) SetCompiler(compiler Compiler) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.compiler = compiler
+}
 
-func (s *State) RunCompiler(uri string) (*CompilerContext, error) {
-	content, exists := s.Documents[uri]
+func (s *State) Compiler() Compiler {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return s.compiler
+}
+
+// RunCompiler exports the current text of uri through the compiler. The
+// compiler process is killed when ctx is cancelled.
+func (s *State) RunCompiler(ctx context.Context, uri string) (*CompilerContext, error) {
+	compiled, _, err := s.compile(ctx, uri)
+	return compiled, err
+}
+
+// compile is RunCompiler that also returns the version of the text
+// compiled, which may be behind the document by the time it returns.
+func (s *State) compile(ctx context.Context, uri string) (*CompilerContext, int, error) {
+	doc, exists := s.snapshot(uri)
 	if !exists {
-		return nil, fmt.Errorf("document not found: %s", uri)
+		return nil, 0, fmt.Errorf("document not found: %s", uri)
 	}
+	content, version := doc.Text(), doc.Version()
 
 	tmpFile, err := os.CreateTemp("", "lsp-*.code")
 	if err != nil {
-		return nil, err
+		return nil, version, err
 	}
 	defer os.Remove(tmpFile.Name())
 
 	if _, err := tmpFile.WriteString(content); err != nil {
-		return nil, err
+		return nil, version, err
 	}
 	tmpFile.Close()
 
-    cmd := exec.Command(CompilerPath, "--export-json", tmpFile.Name())
-    var stderr bytes.Buffer
-    cmd.Stderr = &stderr  // stderr separately
-    output, err := cmd.Output()  // stdout only
-
+	output, err := s.Compiler().Export(ctx, tmpFile.Name())
 	if err != nil {
-		return nil, fmt.Errorf("compilation failed: %v\n%s", err, string(output))
+		return nil, version, err
 	}
 
     //logCompilerOutput(output, s.Logger)
 
-	var ctx CompilerContext
-	if err := json.Unmarshal(output, &ctx); err != nil {
-		return nil, fmt.Errorf("JSON parse error: %v", err)
+	var compiled CompilerContext
+	if err := json.Unmarshal(output, &compiled); err != nil {
+		path := ""
+		if c, ok := s.Compiler().(ExecCompiler); ok {
+			path = c.Path
+		}
+		return nil, version, &CompilerError{Kind: CompilerBadOutput, Path: path, Err: err}
 	}
 
-	return &ctx, nil
+	// positions are for the text compiled, not what it may have become
+	compiled.fromBytes(&doc)
+	return &compiled, version, nil
 }
 
-func (s *State) GetDiagnostics(uri string) []lsp.Diagnostic {
-	ctx, err := s.RunCompiler(uri)
+// GetDiagnostics compiles uri and returns what the compiler reported, and
+// the version of the document they are for. A compiler that fails to run
+// is an error, not a diagnostic in the file.
+func (s *State) GetDiagnostics(ctx context.Context, uri string) ([]lsp.Diagnostic, int, error) {
+	compiled, version, err := s.compile(ctx, uri)
 	if err != nil {
-		return []lsp.Diagnostic{{
-            Range:    LineRange(0,0,0),
-            Severity: 1,
-            Source:   "sunny-lsp:compiler",
-			Message:  err.Error(),
-		}}
+		return nil, version, err
 	}
-	return ctx.Diagnostics
+	return compiled.Diagnostics, version, nil
+}
+
+// Document returns the current text of uri.
+func (s *State) Document(uri string) (string, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return "", false
+    }
+    return doc.Text(), true
 }
 
-func (s *State) OpenDocument(uri, text string) []lsp.Diagnostic {
-    s.Documents[uri] = text
-    return s.GetDiagnostics(uri)
+// Version returns the version of uri the client last told us about.
+func (s *State) Version(uri string) (int, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return 0, false
+    }
+    return doc.Version(), true
 }
 
-func (s *State) UpdateDocument(uri, text string) []lsp.Diagnostic {
-    s.Documents[uri] = text
-    return s.GetDiagnostics(uri)
+// snapshot returns a copy of the document at uri that later changes
+// leave alone.
+func (s *State) snapshot(uri string) (Document, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return Document{}, false
+    }
+    return *doc, true
 }
 
-func (s *State) Hover(id int, uri string, pos lsp.Position) lsp.HoverResponse {
-	ctx, err := s.RunCompiler(uri)
+// DocumentURIs lists the open documents.
+func (s *State) DocumentURIs() []string {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    return slices.Collect(maps.Keys(s.Documents))
+}
+
+func (s *State) OpenDocument(uri, text string, version int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    doc := NewDocument(text, s.Encoding)
+    doc.version = version
+    s.Documents[uri] = doc
+}
+
+// CloseDocument forgets uri; the client's file is the truth again.
+func (s *State) CloseDocument(uri string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    delete(s.Documents, uri)
+}
+
+// ChangeDocument applies the changes of one didChange in order and moves
+// the document to version. If one fails the ones after it are dropped, as
+// they were made to the text it would have produced.
+func (s *State) ChangeDocument(uri string, version int, changes []lsp.TextDocumentContentChangeEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    doc, exists := s.Documents[uri]
+    if !exists {
+        return fmt.Errorf("document not found: %s", uri)
+    }
+    // even a change that fails leaves the text behind the client's, so
+    // older results are no better
+    doc.version = version
+    for _, change := range changes {
+        if err := doc.Apply(change); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *State) Hover(ctx context.Context, uri string, pos lsp.Position) lsp.HoverResult {
+	compiled, err := s.RunCompiler(ctx, uri)
 	if err != nil {
-		return lsp.HoverResponse{
-			Response: lsp.Response{
-				RPC: "2.0",
-				ID:  &id,
-			},
-			Result: lsp.HoverResult{
-				Contents: "Error: " + err.Error(),
-			},
+		return lsp.HoverResult{
+			Contents: s.hoverContents("Error: " + err.Error()),
 		}
 	}
 
 	// check diagnostics first
-	for _, diag := range ctx.Diagnostics {
+	for _, diag := range compiled.Diagnostics {
 		if positionInRange(pos, diag.Range) {
-			return lsp.HoverResponse{
-				Response: lsp.Response{
-					RPC: "2.0",
-					ID:  &id,
-				},
-				Result: lsp.HoverResult{
-					Contents: diag.Message,
-				},
+			return lsp.HoverResult{
+				Contents: s.hoverContents(diag.Message),
 			}
 		}
 	}
 
 	// find AST node and its associated symbol
-	node, symbol := findSymbolDefinition(ctx, pos)
+	node, symbol := findSymbolDefinition(compiled, pos)
 	if node == nil {
-		return lsp.HoverResponse{
-			Response: lsp.Response{
-				RPC: "2.0",
-				ID:  &id,
-			},
-			Result: lsp.HoverResult{
-				Contents: "No information found at position",
-			},
+		return lsp.HoverResult{
+			Contents: s.hoverContents("No information found at position"),
 		}
 	}
 
-	// build hover content
+	// build hover content, only emphasized if the client renders markdown
+	markdown := s.Client.MarkdownHover()
 	var content strings.Builder
-    content.WriteString(fmt.Sprintf("**%s**", node.Name))
+	if markdown {
+		content.WriteString(fmt.Sprintf("**%s**", node.Name))
+	} else {
+		content.WriteString(node.Name)
+	}
 
+	typeName := node.LiteralType
 	if symbol != nil {
-		content.WriteString(fmt.Sprintf(" : *%s*", symbol.Type))
-	} else if node.LiteralType != "" {
-		content.WriteString(fmt.Sprintf(" : *%s*", node.LiteralType))
+		typeName = symbol.Type
+	}
+	if typeName != "" && markdown {
+		content.WriteString(fmt.Sprintf(" : *%s*", typeName))
+	} else if typeName != "" {
+		content.WriteString(fmt.Sprintf(" : %s", typeName))
 	}
 
 	if symbol != nil && len(symbol.ReachableScopes) > 0 {
 		content.WriteString(fmt.Sprintf("\nVisible in %d scopes", len(symbol.ReachableScopes)))
 	}
 
-	return lsp.HoverResponse{
-		Response: lsp.Response{
-			RPC: "2.0",
-			ID:  &id,
-		},
-		Result: lsp.HoverResult{
-			Contents: content.String(),
-		},
+	return lsp.HoverResult{
+		Contents: s.hoverContents(content.String()),
 	}
 }
 
-// Jump to Definition gd
-func (s *State) Definition(id int, uri string, pos lsp.Position) lsp.DefinitionResponse {
-	ctx, err := s.RunCompiler(uri)
-	if err != nil {
-		return lsp.DefinitionResponse{
-            Response: lsp.Response {
-                RPC: "2.0",
-                ID: &id,
-            },
-			Result: lsp.Location{
-				URI:   uri,
-                // do not move character at all
-                Range: lsp.Range{
-                    Start: pos,
-                    End: pos,
-                },
-            },
-        }
+func (s *State) hoverContents(value string) lsp.MarkupContent {
+	kind := lsp.PlainText
+	if s.Client.MarkdownHover() {
+		kind = lsp.Markdown
 	}
+	return lsp.MarkupContent{
+		Kind:  kind,
+		Value: value,
+	}
+}
 
-	if _, symbol := findSymbolDefinition(ctx, pos); symbol != nil {
-		return lsp.DefinitionResponse{
-            Response: lsp.Response {
-                RPC: "2.0",
-                ID: &id,
-            },
-			Result: lsp.Location{
+// Jump to Definition gd
+func (s *State) Definition(ctx context.Context, uri string, pos lsp.Position) lsp.Location {
+	compiled, err := s.RunCompiler(ctx, uri)
+	if err == nil {
+		if _, symbol := findSymbolDefinition(compiled, pos); symbol != nil {
+			return lsp.Location{
 				URI:   uri,
 				Range: symbol.Range,
-			},
+			}
 		}
 	}
 
-	return lsp.DefinitionResponse{
-        Response: lsp.Response {
-            RPC: "2.0",
-            ID: &id,
+	// do not move character at all
+	return lsp.Location{
+		URI:   uri,
+		Range: lsp.Range{
+            Start: pos,
+            End: pos,
         },
-		Result: lsp.Location{
-			URI:   uri,
-			Range: lsp.Range{
-                Start: pos,
-                End: pos,
-            },
-		},
 	}
 }
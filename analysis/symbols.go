@@ -0,0 +1,119 @@
+package analysis
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sunny-lsp/lsp"
+)
+
+// symbolEntry is a symbol with the scope it is declared in, used to nest
+// symbols under the function that declares them.
+type symbolEntry struct {
+    symbol lsp.DocumentSymbol
+    scope int
+    children []*symbolEntry
+}
+
+// DocumentSymbols returns []lsp.DocumentSymbol to clients that can show
+// the hierarchy, and a flat []lsp.SymbolInformation to the rest.
+func (s *State) DocumentSymbols(ctx context.Context, uri string) any {
+    compiled, err := s.RunCompiler(ctx, uri)
+    if err != nil {
+        return []lsp.SymbolInformation{}
+    }
+
+    roots := nestSymbols(compiled)
+    if s.Client.HierarchicalSymbols() {
+        return toDocumentSymbols(roots)
+    }
+    return toSymbolInformation(uri, "", roots, []lsp.SymbolInformation{})
+}
+
+// nestSymbols orders the symbol table by position and places every symbol
+// under the closest function before it that is declared in an outer scope.
+func nestSymbols(ctx *CompilerContext) []*symbolEntry {
+    symbols := slices.Clone(ctx.SymbolTable)
+    slices.SortStableFunc(symbols, func(a, b SymbolNode) int {
+        if a.Range.Start.Line != b.Range.Start.Line {
+            return a.Range.Start.Line - b.Range.Start.Line
+        }
+        return a.Range.Start.Character - b.Range.Start.Character
+    })
+
+    var roots []*symbolEntry
+    var functions []*symbolEntry
+    for _, symbol := range symbols {
+        entry := &symbolEntry{
+            symbol: lsp.DocumentSymbol{
+                Name: symbol.Name,
+                Detail: symbol.Type,
+                Kind: symbolKind(symbol),
+                Range: symbol.Range,
+                SelectionRange: symbol.Range,
+            },
+            scope: findDeclarationScope(ctx, symbol.Range),
+        }
+
+        for len(functions) > 0 && functions[len(functions)-1].scope >= entry.scope {
+            functions = functions[:len(functions)-1]
+        }
+        if len(functions) > 0 {
+            parent := functions[len(functions)-1]
+            parent.children = append(parent.children, entry)
+        } else {
+            roots = append(roots, entry)
+        }
+
+        if entry.symbol.Kind == lsp.SymbolKindFunction {
+            functions = append(functions, entry)
+        }
+    }
+    return roots
+}
+
+// the compiler exports function types as their signature, e.g. "func(i32) i32"
+func symbolKind(symbol SymbolNode) int {
+    if strings.HasPrefix(symbol.Type, "func") {
+        return lsp.SymbolKindFunction
+    }
+    return lsp.SymbolKindVariable
+}
+
+func toDocumentSymbols(entries []*symbolEntry) []lsp.DocumentSymbol {
+    symbols := []lsp.DocumentSymbol{}
+    for _, entry := range entries {
+        symbol := entry.symbol
+        if len(entry.children) > 0 {
+            symbol.Children = toDocumentSymbols(entry.children)
+            // the compiler only gives the name's range, stretch it so the
+            // function encloses what it declares
+            last := symbol.Children[len(symbol.Children)-1].Range.End
+            if positionBefore(symbol.Range.End, last) {
+                symbol.Range.End = last
+            }
+        }
+        symbols = append(symbols, symbol)
+    }
+    return symbols
+}
+
+func positionBefore(a, b lsp.Position) bool {
+    return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
+
+func toSymbolInformation(uri, container string, entries []*symbolEntry, out []lsp.SymbolInformation) []lsp.SymbolInformation {
+    for _, entry := range entries {
+        out = append(out, lsp.SymbolInformation{
+            Name: entry.symbol.Name,
+            Kind: entry.symbol.Kind,
+            Location: lsp.Location{
+                URI: uri,
+                Range: entry.symbol.Range,
+            },
+            ContainerName: container,
+        })
+        out = toSymbolInformation(uri, entry.symbol.Name, entry.children, out)
+    }
+    return out
+}
@@ -3,16 +3,25 @@ package analysis
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"os"
 	"slices"
+	"sync"
 	"sunny-lsp/lsp"
 )
 
 type State struct {
-    // map of file name to content
-	Documents map[string]string
-    Logger *log.Logger
+    mu sync.RWMutex
+
+    // open documents by uri
+	Documents map[string]*Document
+    Logger *slog.Logger
+    compiler Compiler
+
+    // set once by initialize, before any other request is handled
+    Client lsp.ClientCapabilities
+    // what position characters count, for documents opened from then on
+    Encoding string
 }
 
 type SymbolNode struct {
@@ -36,18 +45,35 @@ type CompilerContext struct {
 	Diagnostics []lsp.Diagnostic `json:"diagnostics"`
 }
 
-func logCompilerOutput(output []byte, logger *log.Logger) {
+// fromBytes converts every position the compiler exported for doc to the
+// document's encoding.
+func (c *CompilerContext) fromBytes(doc *Document) {
+    convert := func(r *lsp.Range) {
+        r.Start, r.End = doc.FromBytes(r.Start), doc.FromBytes(r.End)
+    }
+    for i := range c.SymbolTable {
+        convert(&c.SymbolTable[i].Range)
+    }
+    for i := range c.AST {
+        convert(&c.AST[i].Range)
+    }
+    for i := range c.Diagnostics {
+        convert(&c.Diagnostics[i].Range)
+    }
+}
+
+func logCompilerOutput(output []byte, logger *slog.Logger) {
     prettyPath := "/tmp/compiler_output.pretty.json"
     var prettyJSON bytes.Buffer
     if err := json.Indent(&prettyJSON, output, "", "  "); err != nil {
-        logger.Printf("Couldn't format JSON: %v", err)
+        logger.Warn("Could not format compiler output", "err", err)
         return
     }
     if err := os.WriteFile(prettyPath, prettyJSON.Bytes(), 0644); err != nil {
-        logger.Printf("Error saving pretty JSON: %v", err)
+        logger.Warn("Could not save compiler output", "err", err)
         return
     }
-    logger.Printf("Saved compiler output to: %s", prettyPath)
+    logger.Debug("Saved compiler output", "path", prettyPath)
 }
 
 func findSymbolDefinition(ctx *CompilerContext, pos lsp.Position) (*ASTNode, *SymbolNode) {
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sunny-lsp/analysis"
+	"sunny-lsp/lsp"
+)
+
+var severityNames = map[int]string{
+    lsp.DiagnosticError: "error",
+    lsp.DiagnosticWarning: "warning",
+    lsp.DiagnosticInformation: "info",
+    lsp.DiagnosticHint: "hint",
+}
+
+// runCheck compiles each file the way the server would and prints its
+// diagnostics. It exits 1 if any file has errors, and 2 if the compiler
+// could not be run.
+func runCheck(args []string) int {
+    flags := flag.NewFlagSet("check", flag.ExitOnError)
+    layer := configFlags(flags)
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "usage: sunny-lsp check [flags] <file>...\n")
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() == 0 {
+        flags.Usage()
+        return 2
+    }
+
+    cfg := loadConfig(*layer)
+    logger := slog.New(slog.DiscardHandler)
+    if layer.LogFile != nil {
+        // only log when asked to, check is run by hand or in scripts
+        level, _ := parseLevel(cfg.LogLevel)
+        if l, file, err := openLog(cfg.LogFile, level); err == nil {
+            logger = l
+            if file != nil {
+                defer file.Close()
+            }
+        }
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
+    state := analysis.NewState(logger, analysis.ExecCompiler{Path: cfg.CompilerPath})
+    // columns are printed in bytes, as compilers do
+    state.Encoding = lsp.PositionEncodingUTF8
+    status := 0
+    for _, filename := range flags.Args() {
+        text, err := os.ReadFile(filename)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s\n", err)
+            status = 2
+            continue
+        }
+        path, err := filepath.Abs(filename)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+            status = 2
+            continue
+        }
+
+        uri := (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+        state.OpenDocument(uri, string(text), 0)
+        diagnostics, _, err := state.GetDiagnostics(ctx, uri)
+        if err != nil {
+            fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+            var compilerErr *analysis.CompilerError
+            if errors.As(err, &compilerErr) || ctx.Err() != nil {
+                // no point in trying the other files
+                return 2
+            }
+            status = 2
+            continue
+        }
+
+        for _, diagnostic := range diagnostics {
+            severity, ok := severityNames[diagnostic.Severity]
+            if !ok {
+                severity = "error"
+            }
+            start := diagnostic.Range.Start
+            fmt.Printf("%s:%d:%d: %s: %s\n", filename, start.Line+1, start.Character+1, severity, diagnostic.Message)
+            if severity == "error" && status == 0 {
+                status = 1
+            }
+        }
+    }
+    return status
+}
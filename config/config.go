@@ -0,0 +1,148 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sunny-lsp/rpc"
+)
+
+// Section is the key clients keep our settings under, e.g.
+// {"sunny": {"compilerPath": "..."}}.
+const Section = "sunny"
+
+// Config is the server configuration with every layer applied.
+//
+// Layers are applied in this order, later ones winning: Default,
+// environment variables, command-line flags, initializationOptions, and
+// finally the client settings, whether pushed by
+// workspace/didChangeConfiguration or pulled with workspace/configuration.
+type Config struct {
+    // compiler binary, looked up on PATH unless it is a path
+    CompilerPath string
+    // LogFile and TraceFile are only read at startup. LogFile may also be
+    // "stderr", or "none" to turn the log off.
+    LogFile string
+    TraceFile string
+    // debug, info, warn or error
+    LogLevel string
+    Completion bool
+    // run the compiler only when a document is opened or saved, with
+    // cheaper checks while typing
+    CompileOnSave bool
+    // trim trailing whitespace and end files with a newline when the
+    // client asks for edits before saving
+    FormatOnSave bool
+    // milliseconds to wait after the last change before compiling, so a
+    // burst of typing compiles once
+    DiagnosticsDelay int
+    // largest message read from the client, in bytes; only read at startup
+    MaxMessageSize int
+}
+
+func Default() Config {
+    return Config{
+        CompilerPath: "compile.out",
+        LogFile: filepath.Join(os.TempDir(), "sunny-lsp.log"),
+        LogLevel: "info",
+        Completion: true,
+        DiagnosticsDelay: 200,
+        MaxMessageSize: rpc.DefaultMaxMessageSize,
+    }
+}
+
+// Layer is one source of settings. Nil fields leave the value from the
+// layers below untouched.
+type Layer struct {
+    CompilerPath *string `json:"compilerPath"`
+    LogFile *string `json:"logFile"`
+    TraceFile *string `json:"traceFile"`
+    LogLevel *string `json:"logLevel"`
+    Completion *bool `json:"completion"`
+    CompileOnSave *bool `json:"compileOnSave"`
+    FormatOnSave *bool `json:"formatOnSave"`
+    DiagnosticsDelay *int `json:"diagnosticsDelay"`
+    MaxMessageSize *int `json:"maxMessageSize"`
+}
+
+// With returns c with every field set in l applied.
+func (c Config) With(l Layer) Config {
+    if l.CompilerPath != nil {
+        c.CompilerPath = *l.CompilerPath
+    }
+    if l.LogFile != nil {
+        c.LogFile = *l.LogFile
+    }
+    if l.TraceFile != nil {
+        c.TraceFile = *l.TraceFile
+    }
+    if l.LogLevel != nil {
+        c.LogLevel = *l.LogLevel
+    }
+    if l.Completion != nil {
+        c.Completion = *l.Completion
+    }
+    if l.CompileOnSave != nil {
+        c.CompileOnSave = *l.CompileOnSave
+    }
+    if l.FormatOnSave != nil {
+        c.FormatOnSave = *l.FormatOnSave
+    }
+    if l.DiagnosticsDelay != nil {
+        c.DiagnosticsDelay = max(0, *l.DiagnosticsDelay)
+    }
+    if l.MaxMessageSize != nil && *l.MaxMessageSize > 0 {
+        c.MaxMessageSize = *l.MaxMessageSize
+    }
+    return c
+}
+
+// Environment variables read by FromEnv.
+const (
+    EnvCompiler = "SUNNY_LSP_COMPILER"
+    EnvLogFile = "SUNNY_LSP_LOG_FILE"
+    EnvTraceFile = "SUNNY_LSP_TRACE_FILE"
+    EnvLogLevel = "SUNNY_LSP_LOG_LEVEL"
+)
+
+// FromEnv reads a layer from the environment through lookup, which is
+// normally os.LookupEnv.
+func FromEnv(lookup func(key string) (string, bool)) Layer {
+    var l Layer
+    if value, ok := lookup(EnvCompiler); ok {
+        l.CompilerPath = &value
+    }
+    if value, ok := lookup(EnvLogFile); ok {
+        l.LogFile = &value
+    }
+    if value, ok := lookup(EnvTraceFile); ok {
+        l.TraceFile = &value
+    }
+    if value, ok := lookup(EnvLogLevel); ok {
+        l.LogLevel = &value
+    }
+    return l
+}
+
+// FromJSON reads a layer from client settings. The settings may be our
+// section on its own or an object that holds it under Section; null and
+// empty input give an empty layer.
+func FromJSON(data []byte) (Layer, error) {
+    var l Layer
+    if len(data) == 0 || string(data) == "null" {
+        return l, nil
+    }
+
+    var wrapped map[string]json.RawMessage
+    if err := json.Unmarshal(data, &wrapped); err != nil {
+        return l, err
+    }
+    if section, ok := wrapped[Section]; ok {
+        data = section
+    }
+
+    if err := json.Unmarshal(data, &l); err != nil {
+        return l, err
+    }
+    return l, nil
+}
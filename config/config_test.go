@@ -0,0 +1,54 @@
+package config_test
+
+import (
+	"sunny-lsp/config"
+	"testing"
+)
+
+func TestLayers(t *testing.T) {
+    env := map[string]string{
+        config.EnvCompiler: "/env/compile.out",
+        config.EnvLogFile: "/env/log.txt",
+    }
+    lookup := func(key string) (string, bool) {
+        value, ok := env[key]
+        return value, ok
+    }
+
+    flagPath := "/flag/compile.out"
+    init, err := config.FromJSON([]byte(`{"traceFile":"/init/trace.jsonl"}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    settings, err := config.FromJSON([]byte(`{"sunny":{"compilerPath":"/settings/compile.out"}}`))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    cfg := config.Default().
+        With(config.FromEnv(lookup)).
+        With(config.Layer{CompilerPath: &flagPath})
+    if cfg.CompilerPath != flagPath || cfg.LogFile != "/env/log.txt" {
+        t.Fatalf("Expected flag compiler and env log file, Actual %+v", cfg)
+    }
+
+    cfg = cfg.With(init).With(settings)
+    if cfg.CompilerPath != "/settings/compile.out" {
+        t.Fatalf("Expected settings to win, Actual %s", cfg.CompilerPath)
+    }
+    if cfg.TraceFile != "/init/trace.jsonl" || cfg.LogFile != "/env/log.txt" {
+        t.Fatalf("Expected unset fields to be kept, Actual %+v", cfg)
+    }
+}
+
+func TestFromJSONNull(t *testing.T) {
+    for _, input := range []string{"", "null", "{}", `{"sunny":{}}`} {
+        layer, err := config.FromJSON([]byte(input))
+        if err != nil {
+            t.Fatalf("%q: %v", input, err)
+        }
+        if layer != (config.Layer{}) {
+            t.Fatalf("%q: Expected empty layer, Actual %+v", input, layer)
+        }
+    }
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"sunny-lsp/rpc"
+	"sync"
+	"time"
+)
+
+// crashMessages is how many of the last protocol messages a crash dump
+// holds.
+const crashMessages = 100
+
+// recentMessages keeps the last crashMessages protocol messages of a
+// session, to show what led up to a crash.
+type recentMessages struct {
+    mu sync.Mutex
+    entries []traceEntry
+    next int
+}
+
+// attach records the messages of conn, keeping any tracer it has.
+func (r *recentMessages) attach(conn *rpc.Conn) {
+    trace := conn.Trace
+    conn.Trace = func(dir rpc.Direction, content []byte) {
+        r.add(dir, content)
+        if trace != nil {
+            trace(dir, content)
+        }
+    }
+}
+
+func (r *recentMessages) add(dir rpc.Direction, content []byte) {
+    entry := traceEntry{
+        Time: time.Now(),
+        Direction: dir,
+        Message: slices.Clone(content),
+    }
+    if !json.Valid(content) {
+        entry.Message, _ = json.Marshal(string(content))
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if len(r.entries) < crashMessages {
+        r.entries = append(r.entries, entry)
+        return
+    }
+    r.entries[r.next] = entry
+    r.next = (r.next + 1) % crashMessages
+}
+
+// list returns the messages oldest first.
+func (r *recentMessages) list() []traceEntry {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return slices.Concat(r.entries[r.next:], r.entries[:r.next])
+}
+
+type crashDump struct {
+    Time time.Time `json:"time"`
+    // the method being handled, or what else was running
+    Method string `json:"method"`
+    Panic string `json:"panic"`
+    Stack string `json:"stack"`
+    // text of the document involved, by uri
+    Documents map[string]string `json:"documents"`
+    Messages []traceEntry `json:"messages"`
+}
+
+// crashed logs a recovered panic with its stack and writes a crash dump.
+// uri is the document involved, if any. It must be called from the
+// deferred function that recovered, so the stack is that of the panic.
+func (s *session) crashed(method, uri string, value any) {
+    stack := debug.Stack()
+
+    dump := crashDump{
+        Time: time.Now(),
+        Method: method,
+        Panic: fmt.Sprint(value),
+        Stack: string(stack),
+        Documents: map[string]string{},
+        Messages: s.recent.list(),
+    }
+    if text, ok := s.state.Document(uri); ok {
+        dump.Documents[uri] = text
+    }
+
+    filename, err := s.writeCrashDump(dump)
+    if err != nil {
+        s.logger.Error("Panic", "method", method, "panic", value, "stack", string(stack), "dumpErr", err)
+    } else {
+        s.logger.Error("Panic", "method", method, "panic", value, "stack", string(stack), "dump", filename)
+    }
+}
+
+// writeCrashDump writes the dump next to the log, or to the temporary
+// directory if the log doesn't go to a file.
+func (s *session) writeCrashDump(dump crashDump) (string, error) {
+    dir := os.TempDir()
+    if logFileURI(s.baseConfig.LogFile) != "" {
+        dir = filepath.Dir(s.baseConfig.LogFile)
+    }
+
+    data, err := json.MarshalIndent(dump, "", "  ")
+    if err != nil {
+        return "", err
+    }
+    file, err := os.CreateTemp(dir, fmt.Sprintf("sunny-lsp-crash-%s-*.json", dump.Time.Format("20060102-150405")))
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+    if _, err := file.Write(data); err != nil {
+        return "", err
+    }
+    return file.Name(), nil
+}
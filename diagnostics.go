@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sunny-lsp/lsp"
+	"time"
+)
+
+// queueDiagnostics schedules uri to be compiled once it has gone
+// DiagnosticsDelay without being queued again, so a burst of changes
+// compiles once. A compile of uri already running is cancelled, its
+// result would be stale.
+func (s *session) queueDiagnostics(uri string) {
+    s.mu.Lock()
+    s.pending[uri] = time.Now().Add(time.Duration(s.config.DiagnosticsDelay) * time.Millisecond)
+    s.mu.Unlock()
+    s.cancelCompiling(uri)
+
+    select {
+    case s.wake <- struct{}{}:
+    default:
+    }
+}
+
+// unqueueDiagnostics drops uri from the queue, once it is closed.
+func (s *session) unqueueDiagnostics(uri string) {
+    s.mu.Lock()
+    delete(s.pending, uri)
+    s.mu.Unlock()
+    s.cancelCompiling(uri)
+}
+
+// cancelCompiling stops the compile of uri, if one is running.
+func (s *session) cancelCompiling(uri string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.compiling == uri && s.cancelCompile != nil {
+        s.cancelCompile()
+    }
+}
+
+// diagnosticsWorker compiles queued uris as they fall due. Once the
+// client is gone it stops, or with finishOnClose compiles whatever is
+// still queued without waiting.
+func (s *session) diagnosticsWorker() {
+    defer close(s.drained)
+
+    timer := time.NewTimer(time.Hour)
+    timer.Stop()
+    closing := s.closing
+    for {
+        wait, queued := s.publishDue(closing == nil)
+        if s.ctx.Err() != nil || closing == nil && !queued {
+            return
+        }
+        timer.Stop()
+        if queued {
+            timer.Reset(wait)
+        }
+
+        select {
+        case <-s.ctx.Done():
+            return
+        case <-s.wake:
+        case <-timer.C:
+        case <-closing:
+            closing = nil
+        }
+    }
+}
+
+// publishDue compiles every uri that is due, or every queued one if
+// flush, and publishes its diagnostics. It returns how long until the
+// next uri is due, and false if none is queued. Progress is shown if it
+// takes a while, e.g. when every open document is recompiled after the
+// compiler changed.
+//
+// The worker runs from before initialize, so progress, which reads the
+// client capabilities, is only started once there is something to compile.
+func (s *session) publishDue(flush bool) (time.Duration, bool) {
+    var p *progress
+    defer func() { p.end() }()
+
+    for done := 0; ; done++ {
+        uri, ctx, left, wait := s.takeDue(flush)
+        if uri == "" {
+            return wait, wait >= 0
+        }
+        if p == nil {
+            p = s.startProgress("Compiling", nil)
+        }
+        p.report(path.Base(uri), done, done + 1 + left)
+
+        diagnostics, version, err := s.diagnostics(ctx, uri)
+        cancelled := ctx.Err() != nil
+        s.finishCompile()
+        if s.ctx.Err() != nil {
+            return 0, false
+        }
+        if cancelled {
+            // uri changed and is queued again
+            s.logger.Debug("Cancelled stale compile", "uri", uri)
+            continue
+        }
+        if err != nil {
+            // keep what was published last, it is still the best we know
+            s.compilerFailed(uri, err)
+            continue
+        }
+        s.compilerRecovered()
+        s.publishVersion(uri, version, diagnostics)
+    }
+}
+
+// takeDue takes the uri due first off the queue if it is due, or flush,
+// and returns a context that is cancelled if it is queued again while it
+// compiles, and how many other uris are due. With nothing due it returns
+// "" and how long until something is, or -1 if nothing is queued.
+func (s *session) takeDue(flush bool) (string, context.Context, int, time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    first, due := "", 0
+    for uri, at := range s.pending {
+        if first == "" || at.Before(s.pending[first]) {
+            first = uri
+        }
+        if flush || !at.After(now) {
+            due++
+        }
+    }
+    if first == "" {
+        return "", nil, 0, -1
+    }
+    if due == 0 {
+        return "", nil, 0, s.pending[first].Sub(now)
+    }
+
+    delete(s.pending, first)
+    ctx, cancel := context.WithCancel(s.ctx)
+    s.compiling, s.cancelCompile = first, cancel
+    return first, ctx, due - 1, 0
+}
+
+func (s *session) finishCompile() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.cancelCompile()
+    s.compiling, s.cancelCompile = "", nil
+}
+
+// publishVersion publishes the diagnostics for version of uri, unless
+// the document changed while they were worked out or has been closed.
+func (s *session) publishVersion(uri string, version int, diagnostics []lsp.Diagnostic) {
+    s.publishMu.Lock()
+    defer s.publishMu.Unlock()
+    // a changed document is queued again; publishing now would only
+    // flicker back to older diagnostics
+    if current, open := s.state.Version(uri); !open || version < current {
+        s.logger.Debug("Dropped stale diagnostics", "uri", uri, "version", version, "current", current)
+        return
+    }
+    s.publishDiagnostics(uri, &version, diagnostics)
+}
+
+// publishDiagnostics replaces the diagnostics the client shows for uri,
+// unless they are the same ones. version is nil when they aren't for a
+// version of the text, e.g. the empty set sent when a document is closed.
+// s.publishMu must be held.
+func (s *session) publishDiagnostics(uri string, version *int, diagnostics []lsp.Diagnostic) {
+    if last, ok := s.published[uri]; ok && slices.Equal(last, diagnostics) {
+        s.logger.Debug("Diagnostics unchanged", "uri", uri)
+        return
+    }
+    s.published[uri] = diagnostics
+
+    s.writeResponse(lsp.PublishDiagnosticNotification {
+        Notification: lsp.Notification {
+            RPC: "2.0",
+            Method: "textDocument/publishDiagnostics",
+        },
+        Params: lsp.PublishDiagnosticParams {
+            URI: uri,
+            Version: version,
+            Diagnostics: diagnostics,
+        },
+    })
+}
+
+// diagnostics compiles uri and returns the version it compiled. A panic
+// is dumped and returned as an error, the worker has to keep going for the
+// other documents.
+func (s *session) diagnostics(ctx context.Context, uri string) (diagnostics []lsp.Diagnostic, version int, err error) {
+    defer func() {
+        if v := recover(); v != nil {
+            s.crashed("textDocument/publishDiagnostics", uri, v)
+            diagnostics, version, err = nil, 0, fmt.Errorf("panic: %v", v)
+        }
+    }()
+    return s.state.GetDiagnostics(ctx, uri)
+}
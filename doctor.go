@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sunny-lsp/analysis"
+	"sunny-lsp/config"
+	"time"
+)
+
+// doctorTimeout bounds the test compile, a hanging compiler is a finding
+// too.
+const doctorTimeout = 10 * time.Second
+
+// runDoctor checks the setup the server would run with and says what is
+// wrong with it. It exits 1 if any check fails.
+func runDoctor(args []string) int {
+    flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+    layer := configFlags(flags)
+    flags.Func("trace-file", "check the trace file at `path`", func(value string) error {
+        layer.TraceFile = &value
+        return nil
+    })
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "usage: sunny-lsp doctor [flags]\n")
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+
+    cfg := loadConfig(*layer)
+    fmt.Printf("%-10s %s\n", "compiler", cfg.CompilerPath)
+    fmt.Printf("%-10s %s\n", "log file", cfg.LogFile)
+    fmt.Printf("%-10s %s\n", "log level", cfg.LogLevel)
+    if cfg.TraceFile != "" {
+        fmt.Printf("%-10s %s\n", "trace file", cfg.TraceFile)
+    }
+    fmt.Println()
+
+    failed := false
+    report := func(check string, err error) {
+        if err != nil {
+            failed = true
+            fmt.Printf("FAIL %s: %s\n", check, err)
+            return
+        }
+        fmt.Printf("ok   %s\n", check)
+    }
+
+    path, err := exec.LookPath(cfg.CompilerPath)
+    report("compiler found", err)
+    if err == nil {
+        report("compiler runs ("+path+")", checkCompiler(cfg))
+    }
+    _, err = parseLevel(cfg.LogLevel)
+    report("log level", err)
+    report("log file writable", checkWritable(cfg.LogFile))
+    if cfg.TraceFile != "" {
+        report("trace file writable", checkWritable(cfg.TraceFile))
+    }
+
+    if failed {
+        return 1
+    }
+    return 0
+}
+
+// checkCompiler exports an empty file and checks the output can be read.
+func checkCompiler(cfg config.Config) error {
+    file, err := os.CreateTemp("", "lsp-doctor-*.code")
+    if err != nil {
+        return err
+    }
+    file.Close()
+    defer os.Remove(file.Name())
+
+    ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+    defer cancel()
+    output, err := analysis.ExecCompiler{Path: cfg.CompilerPath}.Export(ctx, file.Name())
+    if err != nil {
+        return err
+    }
+    var compiled analysis.CompilerContext
+    if err := json.Unmarshal(output, &compiled); err != nil {
+        return fmt.Errorf("output is not an export: %w", err)
+    }
+    return nil
+}
+
+// checkWritable opens filename for appending, the way the server does.
+// stderr and none always pass.
+func checkWritable(filename string) error {
+    if logFileURI(filename) == "" {
+        return nil
+    }
+    file, err := os.OpenFile(filename, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0666)
+    if err != nil {
+        return err
+    }
+    return file.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"sunny-lsp/config"
+	"sunny-lsp/lsp"
+)
+
+// routes registers the handler of every method the session serves.
+func (s *session) routes() *router {
+    r := newRouter()
+    r.use(s.logMessages, s.recoverPanics, s.gateCapabilities)
+
+    handle(r, "initialize", s.initialize).readLoop()
+    notify(r, "initialized", s.clientInitialized)
+    handle(r, "shutdown", s.shutdown).readLoop()
+    notify(r, "$/cancelRequest", s.cancelRequest)
+    notify(r, "$/setTrace", s.setTrace)
+
+    notify(r, "workspace/didChangeConfiguration", s.didChangeConfiguration)
+    notify(r, "workspace/didChangeWatchedFiles", s.didChangeWatchedFiles)
+    notify(r, "textDocument/didOpen", s.didOpen)
+    notify(r, "textDocument/didChange", s.didChange)
+    notify(r, "textDocument/didClose", s.didClose)
+    notify(r, "textDocument/willSave", s.willSave)
+    handle(r, "textDocument/willSaveWaitUntil", s.willSaveWaitUntil)
+    notify(r, "textDocument/didSave", s.didSave)
+
+    handle(r, "textDocument/hover", s.hover)
+    handle(r, "textDocument/definition", s.definition)
+    handle(r, "textDocument/codeAction", s.codeAction).when(func() bool {
+        return s.client.CodeActionLiterals()
+    })
+    handle(r, "textDocument/completion", s.completion).when(s.completionEnabled)
+    handle(r, "textDocument/documentSymbol", s.documentSymbol)
+    return r
+}
+
+func (s *session) initialize(ctx context.Context, params lsp.InitializeRequestParams) (lsp.InitializeResult, error) {
+    logger := s.log(ctx)
+    s.lifecycle = lifecycleRunning
+    if info := params.ClientInfo; info != nil {
+        logger.Info("Connected", "client", info.Name, "version", info.Version)
+    }
+    if params.ProcessID != nil {
+        logger.Info("Client process", "pid", *params.ProcessID, "locale", params.Locale)
+    }
+
+    s.client = params.Capabilities
+    s.state.Client = params.Capabilities
+    s.state.Encoding = s.client.PositionEncoding()
+    s.workspaceFolders = params.WorkspaceFolders
+    if len(s.workspaceFolders) == 0 && params.RootURI != "" {
+        s.workspaceFolders = []lsp.WorkspaceFolder{{URI: params.RootURI}}
+    }
+
+    if layer, err := config.FromJSON(params.InitializationOptions); err != nil {
+        logger.Warn("Invalid initializationOptions", "err", err)
+    } else {
+        s.mu.Lock()
+        s.initLayer = layer
+        s.mu.Unlock()
+    }
+    s.applyConfig()
+    if params.Trace != "" {
+        s.mu.Lock()
+        s.trace = params.Trace
+        s.mu.Unlock()
+    }
+
+    return lsp.NewInitializeResult(s.client), nil
+}
+
+func (s *session) clientInitialized(ctx context.Context, params struct{}) {
+    s.log(ctx).Info("Client initialized")
+    s.mu.Lock()
+    s.initialized = true
+    s.mu.Unlock()
+    s.updateRegistrations()
+    if s.client.Workspace.Configuration {
+        s.pullConfiguration()
+    }
+}
+
+func (s *session) shutdown(ctx context.Context, params struct{}) (any, error) {
+    s.log(ctx).Info("Shutdown requested")
+    s.lifecycle = lifecycleShutdown
+    return nil, nil
+}
+
+func (s *session) cancelRequest(ctx context.Context, params lsp.CancelParams) {
+    s.mu.Lock()
+    cancel, ok := s.inflight[params.ID]
+    s.mu.Unlock()
+    if ok {
+        s.log(ctx).Debug("Cancelled request", "cancelled", params.ID)
+        cancel()
+    }
+}
+
+func (s *session) setTrace(ctx context.Context, params lsp.SetTraceParams) {
+    s.mu.Lock()
+    s.trace = params.Value
+    s.mu.Unlock()
+}
+
+func (s *session) didChangeConfiguration(ctx context.Context, params lsp.DidChangeConfigurationParams) {
+    // clients that support pulling may only send a hint
+    if s.client.Workspace.Configuration {
+        s.pullConfiguration()
+        return
+    }
+    s.setSettings(params.Settings)
+}
+
+func (s *session) didChangeWatchedFiles(ctx context.Context, params lsp.DidChangeWatchedFilesParams) {
+    s.watchedFilesChanged(params.Changes)
+}
+
+func (s *session) didOpen(ctx context.Context, params lsp.TextDocumentDidOpenParams) {
+    uri := params.TextDocument.URI
+    s.log(ctx).Debug("Opened", "uri", uri, "version", params.TextDocument.Version)
+    s.state.OpenDocument(uri, params.TextDocument.Text, params.TextDocument.Version)
+    s.queueDiagnostics(uri)
+}
+
+func (s *session) didChange(ctx context.Context, params lsp.DidChangeTextDocumentParams) {
+    uri := params.TextDocument.URI
+    s.log(ctx).Debug("Changed", "uri", uri, "version", params.TextDocument.Version, "changes", len(params.ContentChanges))
+    if !s.compileOnSave() {
+        s.changeDocument(ctx, params)
+        s.queueDiagnostics(uri)
+        return
+    }
+
+    // a compile since the last save is stale now
+    s.cancelCompiling(uri)
+    // the quick checks replace whatever was published, so nothing older
+    // may be published in between
+    s.publishMu.Lock()
+    defer s.publishMu.Unlock()
+    s.changeDocument(ctx, params)
+    if diagnostics, version, open := s.state.QuickDiagnostics(uri); open {
+        s.publishDiagnostics(uri, &version, diagnostics)
+    }
+}
+
+func (s *session) changeDocument(ctx context.Context, params lsp.DidChangeTextDocumentParams) {
+    uri := params.TextDocument.URI
+    if err := s.state.ChangeDocument(uri, params.TextDocument.Version, params.ContentChanges); err != nil {
+        // the text no longer matches the client's, reopening the file fixes it
+        s.log(ctx).Error("Could not apply change", "uri", uri, "err", err)
+    }
+}
+
+// compileOnSave is true when the settings keep the compiler for opens
+// and saves.
+func (s *session) compileOnSave() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.config.CompileOnSave
+}
+
+func (s *session) didClose(ctx context.Context, params lsp.DidCloseTextDocumentParams) {
+    uri := params.TextDocument.URI
+    s.log(ctx).Debug("Closed", "uri", uri)
+    s.unqueueDiagnostics(uri)
+
+    s.publishMu.Lock()
+    defer s.publishMu.Unlock()
+    s.state.CloseDocument(uri)
+    // the client keeps showing diagnostics until told otherwise
+    s.publishDiagnostics(uri, nil, []lsp.Diagnostic{})
+    delete(s.published, uri)
+}
+
+func (s *session) willSave(ctx context.Context, params lsp.WillSaveTextDocumentParams) {
+    s.log(ctx).Debug("Saving", "uri", params.TextDocument.URI, "reason", params.Reason)
+}
+
+// willSaveWaitUntil formats the document, if the settings ask for it,
+// with edits the client applies before it saves.
+func (s *session) willSaveWaitUntil(ctx context.Context, params lsp.WillSaveTextDocumentParams) ([]lsp.TextEdit, error) {
+    s.mu.Lock()
+    format := s.config.FormatOnSave
+    s.mu.Unlock()
+    if !format {
+        return []lsp.TextEdit{}, nil
+    }
+    return s.state.Format(params.TextDocument.URI), nil
+}
+
+func (s *session) didSave(ctx context.Context, params lsp.DidSaveTextDocumentParams) {
+    uri := params.TextDocument.URI
+    s.log(ctx).Debug("Saved", "uri", uri)
+    // otherwise every change has already been compiled
+    if s.compileOnSave() {
+        s.queueDiagnostics(uri)
+    }
+}
+
+func (s *session) hover(ctx context.Context, params lsp.HoverParams) (lsp.HoverResult, error) {
+    return s.state.Hover(ctx, params.TextDocument.URI, params.Position), nil
+}
+
+func (s *session) definition(ctx context.Context, params lsp.DefinitionParams) (lsp.Location, error) {
+    return s.state.Definition(ctx, params.TextDocument.URI, params.Position), nil
+}
+
+func (s *session) codeAction(ctx context.Context, params lsp.CodeActionParams) ([]lsp.CodeAction, error) {
+    return s.state.TextCodeAction(params.TextDocument.URI, params.Range), nil
+}
+
+func (s *session) completion(ctx context.Context, params lsp.CompletionParams) ([]lsp.CompletionItem, error) {
+    // should really also be passing position here
+    return s.state.Completion(params.TextDocument.URI), nil
+}
+
+// completionEnabled is false when the settings turn completion off; only
+// clients without dynamic registration still ask then.
+func (s *session) completionEnabled() bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.config.Completion
+}
+
+func (s *session) documentSymbol(ctx context.Context, params lsp.DocumentSymbolParams) (any, error) {
+    return s.state.DocumentSymbols(ctx, params.TextDocument.URI), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sunny-lsp/lsp"
+	"sunny-lsp/rpc"
+	"sync/atomic"
+)
+
+// openLog opens the log destination named by filename: a file, which is
+// appended to, "stderr", or "" or "none" for no log at all. The file, if
+// any, is returned so it can be closed when the process is done logging.
+func openLog(filename string, level slog.Leveler) (*slog.Logger, *os.File, error) {
+    var w io.Writer
+    var file *os.File
+
+    switch filename {
+    case "", "none":
+        return slog.New(slog.DiscardHandler), nil, nil
+    case "stderr":
+        w = os.Stderr
+    default:
+        var err error
+        file, err = os.OpenFile(filename, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0666)
+        if err != nil {
+            return nil, nil, err
+        }
+        w = file
+    }
+
+    handler := slog.NewTextHandler(w, &slog.HandlerOptions{
+        AddSource: true,
+        Level: level,
+        ReplaceAttr: shortSource,
+    })
+    return slog.New(handler), file, nil
+}
+
+// shortSource logs the source as file:line, the full path is just noise.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+    if a.Key != slog.SourceKey {
+        return a
+    }
+    if source, ok := a.Value.Any().(*slog.Source); ok {
+        a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+    }
+    return a
+}
+
+// parseLevel reads a level such as "debug" or "WARN".
+func parseLevel(value string) (slog.Level, error) {
+    var level slog.Level
+    err := level.UnmarshalText([]byte(value))
+    return level, err
+}
+
+// clientHandler passes records on to the log and also sends warnings and
+// errors to the client as window/logMessage, so they show up in the
+// editor. Failed sends are dropped; logging them would only fail again.
+// Nothing is sent once the client has sent exit.
+type clientHandler struct {
+    slog.Handler
+    conn *rpc.Conn
+    exited *atomic.Bool
+    // attrs added by WithAttrs, already formatted
+    prefix string
+    group string
+}
+
+func newClientHandler(handler slog.Handler, conn *rpc.Conn, exited *atomic.Bool) *clientHandler {
+    return &clientHandler{Handler: handler, conn: conn, exited: exited}
+}
+
+func (h *clientHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return level >= slog.LevelWarn || h.Handler.Enabled(ctx, level)
+}
+
+func (h *clientHandler) Handle(ctx context.Context, record slog.Record) error {
+    var err error
+    if h.Handler.Enabled(ctx, record.Level) {
+        err = h.Handler.Handle(ctx, record)
+    }
+    if record.Level < slog.LevelWarn || h.exited.Load() {
+        return err
+    }
+
+    var message strings.Builder
+    message.WriteString(record.Message)
+    message.WriteString(h.prefix)
+    record.Attrs(func(a slog.Attr) bool {
+        writeAttr(&message, h.group, a)
+        return true
+    })
+
+    messageType := lsp.MessageTypeWarning
+    if record.Level >= slog.LevelError {
+        messageType = lsp.MessageTypeError
+    }
+    h.conn.Notify("window/logMessage", lsp.LogMessageParams{
+        Type: messageType,
+        Message: message.String(),
+    })
+    return err
+}
+
+func (h *clientHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    var prefix strings.Builder
+    prefix.WriteString(h.prefix)
+    for _, a := range attrs {
+        writeAttr(&prefix, h.group, a)
+    }
+    return &clientHandler{
+        Handler: h.Handler.WithAttrs(attrs),
+        conn: h.conn,
+        exited: h.exited,
+        prefix: prefix.String(),
+        group: h.group,
+    }
+}
+
+func (h *clientHandler) WithGroup(name string) slog.Handler {
+    return &clientHandler{
+        Handler: h.Handler.WithGroup(name),
+        conn: h.conn,
+        exited: h.exited,
+        prefix: h.prefix,
+        group: h.group + name + ".",
+    }
+}
+
+func writeAttr(b *strings.Builder, group string, a slog.Attr) {
+    a.Value = a.Value.Resolve()
+    if a.Equal(slog.Attr{}) {
+        return
+    }
+    if a.Value.Kind() == slog.KindGroup {
+        if a.Key != "" {
+            group += a.Key + "."
+        }
+        for _, member := range a.Value.Group() {
+            writeAttr(b, group, member)
+        }
+        return
+    }
+    fmt.Fprintf(b, " %s%s=%v", group, a.Key, a.Value)
+}
@@ -0,0 +1,7 @@
+package lsp
+
+import "sunny-lsp/rpc"
+
+type CancelParams struct {
+    ID rpc.ID `json:"id"`
+}
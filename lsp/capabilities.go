@@ -0,0 +1,123 @@
+package lsp
+
+import "slices"
+
+const (
+    PlainText = "plaintext"
+    Markdown = "markdown"
+)
+
+// PositionEncodingKind is what the Character of a position counts.
+const (
+    PositionEncodingUTF8 = "utf-8"
+    PositionEncodingUTF16 = "utf-16"
+    PositionEncodingUTF32 = "utf-32"
+)
+
+// ClientCapabilities is the part of the client's capabilities the server
+// looks at. Anything the client leaves out reads as unsupported.
+type ClientCapabilities struct {
+    Workspace WorkspaceClientCapabilities `json:"workspace"`
+    TextDocument TextDocumentClientCapabilities `json:"textDocument"`
+    Window WindowClientCapabilities `json:"window"`
+    General GeneralClientCapabilities `json:"general"`
+}
+
+type WorkspaceClientCapabilities struct {
+    ApplyEdit bool `json:"applyEdit"`
+    WorkspaceFolders bool `json:"workspaceFolders"`
+    Configuration bool `json:"configuration"`
+    DidChangeConfiguration DynamicRegistrationCapabilities `json:"didChangeConfiguration"`
+    DidChangeWatchedFiles DynamicRegistrationCapabilities `json:"didChangeWatchedFiles"`
+}
+
+type TextDocumentClientCapabilities struct {
+    Synchronization SynchronizationClientCapabilities `json:"synchronization"`
+    Completion CompletionClientCapabilities `json:"completion"`
+    Hover HoverClientCapabilities `json:"hover"`
+    CodeAction CodeActionClientCapabilities `json:"codeAction"`
+    DocumentSymbol DocumentSymbolClientCapabilities `json:"documentSymbol"`
+    PublishDiagnostics PublishDiagnosticsClientCapabilities `json:"publishDiagnostics"`
+}
+
+type DynamicRegistrationCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+}
+
+type SynchronizationClientCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+    WillSave bool `json:"willSave"`
+    WillSaveWaitUntil bool `json:"willSaveWaitUntil"`
+    DidSave bool `json:"didSave"`
+}
+
+type CompletionClientCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+    CompletionItem struct {
+        SnippetSupport bool `json:"snippetSupport"`
+    } `json:"completionItem"`
+}
+
+type HoverClientCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+    ContentFormat []string `json:"contentFormat"`
+}
+
+type CodeActionClientCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+    // without it the client only understands Command results
+    CodeActionLiteralSupport *struct {
+        CodeActionKind struct {
+            ValueSet []string `json:"valueSet"`
+        } `json:"codeActionKind"`
+    } `json:"codeActionLiteralSupport"`
+}
+
+type DocumentSymbolClientCapabilities struct {
+    DynamicRegistration bool `json:"dynamicRegistration"`
+    HierarchicalDocumentSymbolSupport bool `json:"hierarchicalDocumentSymbolSupport"`
+}
+
+type PublishDiagnosticsClientCapabilities struct {
+    VersionSupport bool `json:"versionSupport"`
+}
+
+type WindowClientCapabilities struct {
+    WorkDoneProgress bool `json:"workDoneProgress"`
+    ShowMessage *struct{} `json:"showMessage"`
+    ShowDocument *struct {
+        Support bool `json:"support"`
+    } `json:"showDocument"`
+}
+
+type GeneralClientCapabilities struct {
+    PositionEncodings []string `json:"positionEncodings"`
+}
+
+func (c ClientCapabilities) MarkdownHover() bool {
+    return slices.Contains(c.TextDocument.Hover.ContentFormat, Markdown)
+}
+
+func (c ClientCapabilities) Snippets() bool {
+    return c.TextDocument.Completion.CompletionItem.SnippetSupport
+}
+
+func (c ClientCapabilities) HierarchicalSymbols() bool {
+    return c.TextDocument.DocumentSymbol.HierarchicalDocumentSymbolSupport
+}
+
+func (c ClientCapabilities) CodeActionLiterals() bool {
+    return c.TextDocument.CodeAction.CodeActionLiteralSupport != nil
+}
+
+// PositionEncoding picks the first encoding the client offers that the
+// server supports. UTF-16 is the one every client must support.
+func (c ClientCapabilities) PositionEncoding() string {
+    for _, encoding := range c.General.PositionEncodings {
+        switch encoding {
+        case PositionEncodingUTF8, PositionEncodingUTF16, PositionEncodingUTF32:
+            return encoding
+        }
+    }
+    return PositionEncodingUTF16
+}
@@ -1,26 +1,27 @@
 package lsp
 
-// Request:
-type InitializeRequest struct {
-    Request
-    Params InitializeRequestParams `json:"params"`
-}
+import "encoding/json"
 
 type InitializeRequestParams struct {
+    // null when the client was not started by another process
+    ProcessID *int `json:"processId"`
     ClientInfo *ClientInfo `json:"clientInfo"`
-    // more to be used for more full-fledged lsp
+    Locale string `json:"locale"`
+    RootURI string `json:"rootUri"`
+    InitializationOptions json.RawMessage `json:"initializationOptions"`
+    Capabilities ClientCapabilities `json:"capabilities"`
+    Trace string `json:"trace"`
+    WorkspaceFolders []WorkspaceFolder `json:"workspaceFolders"`
 }
 
-type ClientInfo struct {
+type WorkspaceFolder struct {
+    URI string `json:"uri"`
     Name string `json:"name"`
-    Version string `json:"version"`
 }
 
-
-// Response:
-type InitializeResponse struct {
-    Response
-    Result InitializeResult `json:"result"`
+type ClientInfo struct {
+    Name string `json:"name"`
+    Version string `json:"version"`
 }
 
 type InitializeResult struct {
@@ -29,36 +30,56 @@ type InitializeResult struct {
 }
 
 type ServerCapabilities struct {
-    TextDocumentSync int `json:"textDocumentSync"`
+    PositionEncoding string `json:"positionEncoding"`
+    TextDocumentSync TextDocumentSyncOptions `json:"textDocumentSync"`
     HoverProvider bool `json:"hoverProvider"`
     DefinitionProvider bool `json:"definitionProvider"`
     CodeActionProvider bool `json:"codeActionProvider"`
-    CompletionProvider map[string]any `json:"completionProvider"`
+    CompletionProvider map[string]any `json:"completionProvider,omitempty"`
+    DocumentSymbolProvider bool `json:"documentSymbolProvider"`
 }
 
+const (
+    ServerName = "sunny-lsp"
+    ServerVersion = "0.1.0"
+)
+
 type ServerInfo struct {
     Name string `json:"name"`
     Version string `json:"version"`
 }
 
-func NewInitializeResponse(id int) InitializeResponse {
-    return InitializeResponse {
-        Response: Response {
-            RPC: "2.0",
-            ID: &id,
-        },
-        Result: InitializeResult {
-            Capabilities: ServerCapabilities {
-                TextDocumentSync: 1,
-                HoverProvider: true,
-                DefinitionProvider: true,
-                CodeActionProvider: true,
-                CompletionProvider: map[string]any{},
-            },
-            ServerInfo: ServerInfo {
-                Name: "sunny-lsp",
-                Version: "0.1.0",
+// NewInitializeResult advertises what the server can do for this client.
+func NewInitializeResult(client ClientCapabilities) InitializeResult {
+    return InitializeResult {
+        Capabilities: ServerCapabilities {
+            PositionEncoding: client.PositionEncoding(),
+            TextDocumentSync: TextDocumentSyncOptions {
+                OpenClose: true,
+                Change: TextDocumentSyncIncremental,
+                WillSave: true,
+                WillSaveWaitUntil: true,
+                Save: &SaveOptions{},
             },
+            HoverProvider: true,
+            DefinitionProvider: true,
+            // our code actions are literals, which older clients can't take
+            CodeActionProvider: client.CodeActionLiterals(),
+            CompletionProvider: completionProvider(client),
+            DocumentSymbolProvider: true,
+        },
+        ServerInfo: ServerInfo {
+            Name: ServerName,
+            Version: ServerVersion,
         },
     }
 }
+
+// completionProvider is nil for clients that take dynamic registration,
+// the server registers completion once it knows it can serve it.
+func completionProvider(client ClientCapabilities) map[string]any {
+    if client.TextDocument.Completion.DynamicRegistration {
+        return nil
+    }
+    return map[string]any{}
+}
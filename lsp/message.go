@@ -1,21 +1,59 @@
 package lsp
 
-type Request struct {
-    RPC string `json:"jsonrpc"` // always 2.0
-    ID int `json:"id"`
-    Method string `json:"method"`
-
-    // Params
-}
+import (
+	"fmt"
+	"sunny-lsp/rpc"
+)
 
 type Response struct {
     RPC string `json:"jsonrpc"` // always 2.0
-    ID *int `json:"id,omitempty"`
+    ID *rpc.ID `json:"id"` // null when the request id could not be read
 
-    // Result, Error
+    // Result
+    Error *ResponseError `json:"error,omitempty"`
 }
 
 type Notification struct {
     RPC string `json:"jsonrpc"`
     Method string `json:"method"`
 }
+
+type ErrorCode int
+
+const (
+    // defined by JSON-RPC
+    ParseError ErrorCode = -32700
+    InvalidRequest ErrorCode = -32600
+    MethodNotFound ErrorCode = -32601
+    InvalidParams ErrorCode = -32602
+    InternalError ErrorCode = -32603
+
+    // defined by LSP
+    ServerNotInitialized ErrorCode = -32002
+    UnknownErrorCode ErrorCode = -32001
+    RequestFailed ErrorCode = -32803
+    ServerCancelled ErrorCode = -32802
+    ContentModified ErrorCode = -32801
+    RequestCancelled ErrorCode = -32800
+)
+
+type ResponseError struct {
+    Code ErrorCode `json:"code"`
+    Message string `json:"message"`
+    Data any `json:"data,omitempty"`
+}
+
+func (e *ResponseError) Error() string {
+    return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+func NewErrorResponse(id *rpc.ID, code ErrorCode, message string) Response {
+    return Response {
+        RPC: "2.0",
+        ID: id,
+        Error: &ResponseError {
+            Code: code,
+            Message: message,
+        },
+    }
+}
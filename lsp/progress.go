@@ -0,0 +1,42 @@
+package lsp
+
+import "encoding/json"
+
+// ProgressToken is an integer or a string. It is kept as sent, so tokens
+// from the client go back unchanged.
+type ProgressToken = json.RawMessage
+
+// WorkDoneProgressParams is embedded in the params of requests that
+// accept a client-created progress token.
+type WorkDoneProgressParams struct {
+    // nil if the client sent none, or null
+    WorkDoneToken *ProgressToken `json:"workDoneToken,omitempty"`
+}
+
+type WorkDoneProgressCreateParams struct {
+    Token ProgressToken `json:"token"`
+}
+
+type ProgressParams struct {
+    Token ProgressToken `json:"token"`
+    Value any `json:"value"`
+}
+
+type WorkDoneProgressBegin struct {
+    Kind string `json:"kind"` // "begin"
+    Title string `json:"title"`
+    Cancellable bool `json:"cancellable,omitempty"`
+    Message string `json:"message,omitempty"`
+    Percentage *int `json:"percentage,omitempty"`
+}
+
+type WorkDoneProgressReport struct {
+    Kind string `json:"kind"` // "report"
+    Message string `json:"message,omitempty"`
+    Percentage *int `json:"percentage,omitempty"`
+}
+
+type WorkDoneProgressEnd struct {
+    Kind string `json:"kind"` // "end"
+    Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,37 @@
+package lsp
+
+type Registration struct {
+    ID string `json:"id"`
+    Method string `json:"method"`
+    RegisterOptions any `json:"registerOptions,omitempty"`
+}
+
+type RegistrationParams struct {
+    Registrations []Registration `json:"registrations"`
+}
+
+type Unregistration struct {
+    ID string `json:"id"`
+    Method string `json:"method"`
+}
+
+type UnregistrationParams struct {
+    // misspelled in the specification, and so on the wire
+    Unregisterations []Unregistration `json:"unregisterations"`
+}
+
+// DocumentFilter selects documents by language, scheme or glob pattern.
+type DocumentFilter struct {
+    Language string `json:"language,omitempty"`
+    Scheme string `json:"scheme,omitempty"`
+    Pattern string `json:"pattern,omitempty"`
+}
+
+type CompletionRegistrationOptions struct {
+    // nil uses the selector the client registered the server for
+    DocumentSelector []DocumentFilter `json:"documentSelector"`
+}
+
+type DidChangeConfigurationRegistrationOptions struct {
+    Section string `json:"section,omitempty"`
+}
@@ -44,6 +44,11 @@ type WorkspaceEdit struct {
     Changes map[string][]TextEdit `json:"changes"`
 }
 
+type MarkupContent struct {
+    Kind string `json:"kind"` // plaintext or markdown
+    Value string `json:"value"`
+}
+
 type TextEdit struct {
     Range Range `json:"range"`
     NewText string `json:"newText"`
@@ -1,21 +1,11 @@
 package lsp
 
-type CodeActionRequest struct {
-    Request
-    Params CodeActionParams `json:"params"`
-}
-
 type CodeActionParams struct {
     TextDocument TextDocumentIdentifier `json:"textDocument"`
     Range Range `json:"range"`
     Context CodeActionContext `json:"context"`
 }
 
-type CodeActionResponse struct {
-    Response
-    Result []CodeAction `json:"result"`
-}
-
 type CodeActionContext struct {
 }
 
@@ -1,21 +1,25 @@
 package lsp
 
-type CompletionRequest struct {
-    Request
-    Params CompletionParams `json:"params"`
-}
-
 type CompletionParams struct {
     TextDocumentPositionParam
 }
 
-type CompletionResponse struct {
-    Response
-    Result []CompletionItem `json:"result"`
-}
-
 type CompletionItem struct {
     Label string `json:"label"`
+    Kind int `json:"kind,omitempty"`
     Detail string `json:"detail"`
     Documentation string `json:"documentation"`
+    InsertText string `json:"insertText,omitempty"`
+    InsertTextFormat int `json:"insertTextFormat,omitempty"`
 }
+
+const (
+    CompletionItemKindKeyword = 14
+    CompletionItemKindSnippet = 15
+    CompletionItemKindTypeParameter = 25
+)
+
+const (
+    InsertTextFormatPlainText = 1
+    InsertTextFormatSnippet = 2
+)
@@ -1,15 +1,6 @@
 package lsp
 
-type DefinitionRequest struct {
-    Request
-    Params DefinitionParams `json:"params"`
-}
-
 type DefinitionParams struct {
     TextDocumentPositionParam
 }
 
-type DefinitionResponse struct {
-    Response
-    Result Location `json:"result"`
-}
@@ -3,11 +3,12 @@ package lsp
 type PublishDiagnosticNotification struct {
     Notification
     Params PublishDiagnosticParams `json:"params"`
-    // generally would also take version for file version
 }
 
 type PublishDiagnosticParams struct {
     URI string `json:"uri"`
+    // version of the document the diagnostics are for, if known
+    Version *int `json:"version,omitempty"`
     Diagnostics []Diagnostic `json:"diagnostics"`
 }
 
@@ -17,3 +18,11 @@ type Diagnostic struct {
     Source string `json:"source"`
     Message string `json:"message"`
 }
+
+// DiagnosticSeverity
+const (
+    DiagnosticError = 1
+    DiagnosticWarning = 2
+    DiagnosticInformation = 3
+    DiagnosticHint = 4
+)
@@ -1,16 +1,36 @@
 package lsp
 
-type TextDocumentDidChangeNotification struct {
-    Notification
-    Params DidChangeTextDocumentParams `json:"params"`
-}
-
 type DidChangeTextDocumentParams struct {
     TextDocument VersionTextDocumentIdentifier `json:"textDocument"`
     ContentChanges []TextDocumentContentChangeEvent `json:"contentChanges"`
 }
 
 type TextDocumentContentChangeEvent struct {
-    // the new text of the whole document
+    // the range replaced by Text; nil when Text is the whole document
+    Range *Range `json:"range,omitempty"`
+    // deprecated, Range is enough
+    RangeLength *int `json:"rangeLength,omitempty"`
     Text string `json:"text"`
 }
+
+// TextDocumentSyncKind is how the client sends document changes.
+const (
+    TextDocumentSyncNone = 0
+    TextDocumentSyncFull = 1
+    TextDocumentSyncIncremental = 2
+)
+
+// TextDocumentSyncOptions says which document notifications the server
+// wants and how changes are sent.
+type TextDocumentSyncOptions struct {
+    OpenClose bool `json:"openClose"`
+    Change int `json:"change"`
+    WillSave bool `json:"willSave"`
+    WillSaveWaitUntil bool `json:"willSaveWaitUntil"`
+    // nil leaves out didSave
+    Save *SaveOptions `json:"save,omitempty"`
+}
+
+type SaveOptions struct {
+    IncludeText bool `json:"includeText"`
+}
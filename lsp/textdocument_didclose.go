@@ -0,0 +1,5 @@
+package lsp
+
+type DidCloseTextDocumentParams struct {
+    TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
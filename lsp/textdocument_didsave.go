@@ -0,0 +1,22 @@
+package lsp
+
+type DidSaveTextDocumentParams struct {
+    TextDocument TextDocumentIdentifier `json:"textDocument"`
+    // only sent when SaveOptions.IncludeText asked for it
+    Text *string `json:"text,omitempty"`
+}
+
+// WillSaveTextDocumentParams are sent by both willSave and
+// willSaveWaitUntil; the latter is answered with []TextEdit to apply
+// before saving.
+type WillSaveTextDocumentParams struct {
+    TextDocument TextDocumentIdentifier `json:"textDocument"`
+    Reason int `json:"reason"`
+}
+
+// TextDocumentSaveReason is why a document is being saved.
+const (
+    TextDocumentSaveReasonManual = 1
+    TextDocumentSaveReasonAfterDelay = 2
+    TextDocumentSaveReasonFocusOut = 3
+)
@@ -0,0 +1,26 @@
+package lsp
+
+type DocumentSymbolParams struct {
+    TextDocument TextDocumentIdentifier `json:"textDocument"`
+}
+
+type DocumentSymbol struct {
+    Name string `json:"name"`
+    Detail string `json:"detail,omitempty"`
+    Kind int `json:"kind"`
+    Range Range `json:"range"`
+    SelectionRange Range `json:"selectionRange"`
+    Children []DocumentSymbol `json:"children,omitempty"`
+}
+
+type SymbolInformation struct {
+    Name string `json:"name"`
+    Kind int `json:"kind"`
+    Location Location `json:"location"`
+    ContainerName string `json:"containerName,omitempty"`
+}
+
+const (
+    SymbolKindFunction = 12
+    SymbolKindVariable = 13
+)
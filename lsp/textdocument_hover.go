@@ -1,19 +1,9 @@
 package lsp
 
-type HoverRequest struct {
-    Request
-    Params HoverParams `json:"params"`
-}
-
 type HoverParams struct {
     TextDocumentPositionParam
 }
 
-type HoverResponse struct {
-    Response
-    Result HoverResult `json:"result"`
-}
-
 type HoverResult struct {
-    Contents string `json:"contents"`
+    Contents MarkupContent `json:"contents"`
 }
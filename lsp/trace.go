@@ -0,0 +1,22 @@
+package lsp
+
+const (
+    TraceOff = "off"
+    TraceMessages = "messages"
+    TraceVerbose = "verbose"
+)
+
+type SetTraceParams struct {
+    Value string `json:"value"`
+}
+
+type LogTraceNotification struct {
+    Notification
+    Params LogTraceParams `json:"params"`
+}
+
+type LogTraceParams struct {
+    Message string `json:"message"`
+    // only sent when the trace value is verbose
+    Verbose string `json:"verbose,omitempty"`
+}
@@ -0,0 +1,35 @@
+package lsp
+
+type MessageType int
+
+const (
+    MessageTypeError MessageType = 1
+    MessageTypeWarning MessageType = 2
+    MessageTypeInfo MessageType = 3
+    MessageTypeLog MessageType = 4
+)
+
+type LogMessageParams struct {
+    Type MessageType `json:"type"`
+    Message string `json:"message"`
+}
+
+type ShowMessageRequestParams struct {
+    Type MessageType `json:"type"`
+    Message string `json:"message"`
+    Actions []MessageActionItem `json:"actions,omitempty"`
+}
+
+type MessageActionItem struct {
+    Title string `json:"title"`
+}
+
+type ShowDocumentParams struct {
+    URI string `json:"uri"`
+    External bool `json:"external,omitempty"`
+    TakeFocus bool `json:"takeFocus,omitempty"`
+}
+
+type ShowDocumentResult struct {
+    Success bool `json:"success"`
+}
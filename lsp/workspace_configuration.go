@@ -0,0 +1,17 @@
+package lsp
+
+import "encoding/json"
+
+type DidChangeConfigurationParams struct {
+    // null from clients that expect the server to pull the settings
+    Settings json.RawMessage `json:"settings"`
+}
+
+type ConfigurationParams struct {
+    Items []ConfigurationItem `json:"items"`
+}
+
+type ConfigurationItem struct {
+    ScopeURI string `json:"scopeUri,omitempty"`
+    Section string `json:"section,omitempty"`
+}
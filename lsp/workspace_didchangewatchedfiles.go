@@ -0,0 +1,26 @@
+package lsp
+
+type DidChangeWatchedFilesRegistrationOptions struct {
+    Watchers []FileSystemWatcher `json:"watchers"`
+}
+
+type FileSystemWatcher struct {
+    GlobPattern string `json:"globPattern"`
+}
+
+type DidChangeWatchedFilesParams struct {
+    Changes []FileEvent `json:"changes"`
+}
+
+type FileChangeType int
+
+const (
+    FileCreated FileChangeType = 1
+    FileChanged FileChangeType = 2
+    FileDeleted FileChangeType = 3
+)
+
+type FileEvent struct {
+    URI string `json:"uri"`
+    Type FileChangeType `json:"type"`
+}
@@ -1,163 +1,229 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"io"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"os"
-	"sunny-lsp/analysis"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sunny-lsp/config"
 	"sunny-lsp/lsp"
 	"sunny-lsp/rpc"
 )
 
-func main() {
-    logger := getLogger("/Users/mdurcan/personal/git_projects/tools/lang-dev/sunny-lsp/log.txt")
-    logger.Println("Logger Started")
+// command is a subcommand of the binary. run gets the arguments after the
+// command name and returns the exit code.
+type command struct {
+    name string
+    summary string
+    run func(args []string) int
+}
 
-    scanner := bufio.NewScanner(os.Stdin)
-    scanner.Split(rpc.Split)
+// commands is set in init, as help refers back to it.
+var commands []command
+
+func init() {
+    commands = []command{
+        {"serve", "run the language server (the default)", runServe},
+        {"check", "compile files and print their diagnostics", runCheck},
+        {"doctor", "check that the compiler, log and trace files are usable", runDoctor},
+        {"version", "print the version", runVersion},
+        {"replay", "replay a recorded trace against this build", runReplay},
+        {"help", "show this help", runHelp},
+    }
+}
 
-    state := analysis.NewState(logger)
-    writer := os.Stdout
+func main() {
+    os.Exit(run(os.Args[1:]))
+}
 
-    for scanner.Scan() {
-        msg := scanner.Bytes()
-        method, contents, err := rpc.DecodeMessage(msg)
-        if err != nil {
-            logger.Printf("Got an error: %s", err)
-            continue
+// run picks the command. Editors launch the bare binary, maybe with serve
+// flags such as --stdio, so anything that isn't a command is served.
+func run(args []string) int {
+    if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+        if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+            return runHelp(nil)
         }
+        return runServe(args)
+    }
 
-        handleMessage(logger, writer, state, method, contents)
+    for _, cmd := range commands {
+        if cmd.name == args[0] {
+            return cmd.run(args[1:])
+        }
     }
+    fmt.Fprintf(os.Stderr, "sunny-lsp: unknown command %q\n", args[0])
+    usage(os.Stderr)
+    return 2
 }
 
-func handleMessage(logger *log.Logger, writer io.Writer, state analysis.State, method string, contents []byte) {
-    logger.Printf("Received msg with method: %s", method)
+func usage(w *os.File) {
+    fmt.Fprintf(w, "usage: sunny-lsp [command] [flags]\n\nCommands:\n")
+    for _, cmd := range commands {
+        fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
+    }
+    fmt.Fprintf(w, "\nWithout a command the server is run as with serve.\n")
+    fmt.Fprintf(w, "Run 'sunny-lsp <command> -h' for the flags of a command.\n")
+}
 
-    switch method {
-    case "initialize":
-        var request lsp.InitializeRequest
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("We could not parse initialize request: %s", err)
-        }
+func runHelp(args []string) int {
+    usage(os.Stdout)
+    fmt.Fprintf(os.Stdout, "\nFlags of serve:\n")
+    flags, _ := serveFlags()
+    flags.SetOutput(os.Stdout)
+    flags.PrintDefaults()
+    return 0
+}
 
-        logger.Printf("Connected to: %s %s",
-            request.Params.ClientInfo.Name,
-            request.Params.ClientInfo.Version)
-
-        msg := lsp.NewInitializeResponse(request.ID)
-        writeResponse(writer, msg)
-    case "textDocument/didOpen":
-        var request lsp.TextDocumentDidOpenNotification
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/didOpen: %s", err)
-            return;
+// configFlags adds the flags every command takes to settle the config.
+func configFlags(flags *flag.FlagSet) *config.Layer {
+    var layer config.Layer
+    flags.Func("compiler", "run the compiler at `path`", func(value string) error {
+        layer.CompilerPath = &value
+        return nil
+    })
+    flags.Func("log-file", "write the server log to `path`, stderr, or none", func(value string) error {
+        layer.LogFile = &value
+        return nil
+    })
+    flags.Func("log-level", "log messages at `level` and above: debug, info, warn or error", func(value string) error {
+        if _, err := parseLevel(value); err != nil {
+            return err
         }
+        layer.LogLevel = &value
+        return nil
+    })
+    return &layer
+}
 
-        uri := request.Params.TextDocument.URI
-        text := request.Params.TextDocument.Text
-        logger.Printf("Opened: %s", uri)
-        diagnostics := state.OpenDocument(uri, text)
-        writeResponse(writer, lsp.PublishDiagnosticNotification {
-            Notification: lsp.Notification {
-                RPC: "2.0",
-                Method: "textDocument/publishDiagnostics",
-            },
-            Params: lsp.PublishDiagnosticParams {
-                URI: uri,
-                Diagnostics: diagnostics,
-            },
-        })
-    case "textDocument/didChange":
-        var request lsp.TextDocumentDidChangeNotification
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/didChange: %s", err)
-            return
-        }
+// loadConfig applies the environment and then the flags to the defaults.
+func loadConfig(flags config.Layer) config.Config {
+    return config.Default().
+        With(config.FromEnv(os.LookupEnv)).
+        With(flags)
+}
 
-        uri := request.Params.TextDocument.URI
-        changes := request.Params.ContentChanges
-        logger.Printf("Changed: %s", uri)
-        for _, change := range changes {
-            diagnostics := state.UpdateDocument(uri, change.Text)
-            writeResponse(writer, lsp.PublishDiagnosticNotification {
-                Notification: lsp.Notification {
-                    RPC: "2.0",
-                    Method: "textDocument/publishDiagnostics",
-                },
-                Params: lsp.PublishDiagnosticParams {
-                    URI: uri,
-                    Diagnostics: diagnostics,
-                },
-            })
-        }
-    case "textDocument/hover":
-        var request lsp.HoverRequest
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/hover: %s", err)
-            return
-        }
+type serveOptions struct {
+    stdio bool
+    listen string
+    socket string
+    multi bool
+    config *config.Layer
+}
 
-        // create response
-        uri := request.Params.TextDocument.URI
-        pos := request.Params.Position
-        response := state.Hover(request.ID, uri, pos)
-
-        // send it to LSP
-        writeResponse(writer, response)
-    case "textDocument/definition":
-        var request lsp.DefinitionRequest
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/definition: %s", err)
-            return
+func serveFlags() (*flag.FlagSet, *serveOptions) {
+    flags := flag.NewFlagSet("serve", flag.ExitOnError)
+    var opts serveOptions
+    flags.BoolVar(&opts.stdio, "stdio", false, "talk to the client over stdin and stdout (the default)")
+    flags.StringVar(&opts.listen, "listen", "", "listen for clients on `addr`, e.g. tcp://127.0.0.1:9257")
+    flags.StringVar(&opts.socket, "socket", "", "listen for clients on the unix socket at `path`")
+    flags.BoolVar(&opts.multi, "multi", false, "keep serving new clients after the first one disconnects")
+    opts.config = configFlags(flags)
+    flags.Func("trace-file", "record every protocol message to `path` as JSONL", func(value string) error {
+        opts.config.TraceFile = &value
+        return nil
+    })
+    flags.Func("max-message-size", fmt.Sprintf("read messages of up to `bytes` from the client (default %d)", rpc.DefaultMaxMessageSize), func(value string) error {
+        size, err := strconv.Atoi(value)
+        if err != nil || size <= 0 {
+            return fmt.Errorf("not a positive number of bytes: %q", value)
         }
+        opts.config.MaxMessageSize = &size
+        return nil
+    })
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "usage: sunny-lsp [serve] [flags]\n")
+        flags.PrintDefaults()
+    }
+    return flags, &opts
+}
 
-        // create response
-        uri := request.Params.TextDocument.URI
-        pos := request.Params.Position
-        response := state.Definition(request.ID, uri, pos)
-
-        // send it to LSP
-        writeResponse(writer, response)
-    case "textDocument/codeAction":
-        var request lsp.CodeActionRequest
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/codeAction: %s", err)
-            return
+func runServe(args []string) int {
+    flags, opts := serveFlags()
+    flags.Parse(args)
+    if flags.NArg() > 0 {
+        fmt.Fprintf(os.Stderr, "sunny-lsp: unexpected argument %q\n", flags.Arg(0))
+        flags.Usage()
+        return 2
+    }
+    transports := 0
+    for _, set := range []bool{opts.stdio, opts.listen != "", opts.socket != ""} {
+        if set {
+            transports++
         }
+    }
+    if transports > 1 {
+        fmt.Fprintln(os.Stderr, "sunny-lsp: --stdio, --listen and --socket cannot be used together")
+        return 2
+    }
 
-        uri := request.Params.TextDocument.URI
-        action_range := request.Params.Range
-        response := state.TextCodeAction(request.ID, uri, action_range)
+    cfg := loadConfig(*opts.config)
 
-        writeResponse(writer, response)
-    case "textDocument/completion":
-        var request lsp.CompletionRequest
-        if err := json.Unmarshal(contents, &request); err != nil {
-            logger.Printf("textDocument/completion: %s", err)
-            return
-        }
+    level := new(slog.LevelVar)
+    if l, err := parseLevel(cfg.LogLevel); err == nil {
+        level.Set(l)
+    } else {
+        fmt.Fprintf(os.Stderr, "sunny-lsp: %s, logging at %s\n", err, level.Level())
+    }
 
-        uri := request.Params.TextDocument.URI
+    logger, logFile, err := openLog(cfg.LogFile, level)
+    if err != nil {
+        // a log we can't open is no reason to leave the editor without
+        // a server
+        fmt.Fprintf(os.Stderr, "sunny-lsp: could not open log file: %s, logging to stderr\n", err)
+        logger, logFile, _ = openLog("stderr", level)
+    }
+    if logFile != nil {
+        defer logFile.Close()
+    }
+    logger.Info("Logger started", "pid", os.Getpid(), "version", lsp.ServerVersion)
 
-        // should really also be passing position here
-        response := state.Completion(request.ID, uri)
+    srv := &server{logger: logger, level: level, config: cfg}
+    if cfg.TraceFile != "" {
+        tracer, err := newTraceRecorder(cfg.TraceFile)
+        if err != nil {
+            logger.Error("Could not open trace file", "err", err)
+            return 1
+        }
+        defer tracer.Close()
+        srv.tracer = tracer
+    }
 
-        writeResponse(writer, response)
+    switch {
+    case opts.listen != "":
+        network, address, parseErr := parseListenAddr(opts.listen)
+        if parseErr != nil {
+            fmt.Fprintf(os.Stderr, "sunny-lsp: %s\n", parseErr)
+            return 2
+        }
+        err = srv.serveListener(network, address, opts.multi)
+    case opts.socket != "":
+        err = srv.serveListener("unix", opts.socket, opts.multi)
+    default:
+        err = srv.serveStdio()
     }
+    if err != nil {
+        logger.Error("Server stopped", "err", err)
+        return 1
+    }
+    return 0
 }
 
-func writeResponse(writer io.Writer, msg any) {
-    reply := rpc.EncodeMessage(msg)
-    writer.Write([]byte(reply))
-}
+func runVersion(args []string) int {
+    flags := flag.NewFlagSet("version", flag.ExitOnError)
+    flags.Parse(args)
 
-func getLogger(filename string) *log.Logger {
-    logfile, err := os.OpenFile(filename, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
-    if err != nil {
-        panic("Invalid log file")
+    fmt.Printf("%s %s", lsp.ServerName, lsp.ServerVersion)
+    if info, ok := debug.ReadBuildInfo(); ok {
+        for _, setting := range info.Settings {
+            if setting.Key == "vcs.revision" {
+                fmt.Printf(" (%.12s)", setting.Value)
+            }
+        }
     }
-    return log.New(logfile, "[sunny-lsp]", log.Ldate|log.Ltime|log.Lshortfile)
+    fmt.Printf(" %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+    return 0
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sunny-lsp/lsp"
+	"sync"
+	"time"
+)
+
+// progressDelay is how long work runs before the server shows progress
+// for it. Most compiles finish sooner, and a spinner flashing on every
+// keystroke is worse than none.
+const progressDelay = 500 * time.Millisecond
+
+// progress reports one piece of work with $/progress. It is safe to use
+// on a nil *progress, which reports nothing.
+//
+// Begin is sent lazily: at once for a token the client made, otherwise
+// after progressDelay, once the client has accepted a token from
+// window/workDoneProgress/create. Reports before that are folded into
+// begin, and end is only sent if begin was.
+type progress struct {
+    s *session
+    title string
+    timer *time.Timer
+
+    mu sync.Mutex
+    token lsp.ProgressToken
+    begun bool
+    ended bool
+    message string
+    percentage *int
+}
+
+// startProgress starts reporting work titled title. token is the
+// workDoneToken the client sent with a request, if any. Without one it
+// returns nil unless the client can create tokens for us.
+func (s *session) startProgress(title string, token lsp.ProgressToken) *progress {
+    p := &progress{s: s, title: title, token: token}
+    if len(token) > 0 {
+        p.begin()
+        return p
+    }
+    if !s.client.Window.WorkDoneProgress {
+        return nil
+    }
+
+    p.timer = time.AfterFunc(progressDelay, func() {
+        token, _ := json.Marshal(fmt.Sprintf("sunny-lsp/%d", s.progressTokens.Add(1)))
+        params := lsp.WorkDoneProgressCreateParams{Token: token}
+        if err := s.conn.Call(s.ctx, "window/workDoneProgress/create", params, nil); err != nil {
+            s.logger.Debug("Could not create progress", "err", err)
+            return
+        }
+
+        p.mu.Lock()
+        p.token = token
+        p.mu.Unlock()
+        p.begin()
+    })
+    return p
+}
+
+func (p *progress) begin() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.ended {
+        return
+    }
+    p.begun = true
+    p.send(lsp.WorkDoneProgressBegin{
+        Kind: "begin",
+        Title: p.title,
+        Message: p.message,
+        Percentage: p.percentage,
+    })
+}
+
+// report updates the message and, if done and total are both set, the
+// percentage of the work done.
+func (p *progress) report(message string, done, total int) {
+    if p == nil {
+        return
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    p.message = message
+    if total > 0 {
+        percentage := done * 100 / total
+        p.percentage = &percentage
+    }
+    if p.begun && !p.ended {
+        p.send(lsp.WorkDoneProgressReport{
+            Kind: "report",
+            Message: p.message,
+            Percentage: p.percentage,
+        })
+    }
+}
+
+func (p *progress) end() {
+    if p == nil {
+        return
+    }
+    if p.timer != nil {
+        p.timer.Stop()
+    }
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if p.ended {
+        return
+    }
+    p.ended = true
+    if p.begun {
+        p.send(lsp.WorkDoneProgressEnd{Kind: "end"})
+    }
+}
+
+// send is called with p.mu held, which keeps begin, report and end in
+// order on the wire.
+func (p *progress) send(value any) {
+    p.s.conn.Notify("$/progress", lsp.ProgressParams{Token: p.token, Value: value})
+}
+
+type progressKey struct{}
+
+// withProgress attaches the progress of a request to its context.
+func withProgress(ctx context.Context, p *progress) context.Context {
+    return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *progress {
+    p, _ := ctx.Value(progressKey{}).(*progress)
+    return p
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sunny-lsp/config"
+	"sunny-lsp/lsp"
+)
+
+// sourcePattern matches the files the compiler reads.
+const sourcePattern = "**/*.sunny"
+
+// wantedRegistrations returns the options of every capability that should
+// be registered with the client right now, by method. The method doubles
+// as the registration id, as each is registered at most once.
+func (s *session) wantedRegistrations() map[string]any {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    wanted := map[string]any{}
+    if !s.initialized {
+        return wanted
+    }
+
+    if s.client.Workspace.DidChangeWatchedFiles.DynamicRegistration {
+        wanted["workspace/didChangeWatchedFiles"] = lsp.DidChangeWatchedFilesRegistrationOptions{
+            Watchers: []lsp.FileSystemWatcher{
+                {GlobPattern: sourcePattern},
+            },
+        }
+    }
+    if s.client.Workspace.DidChangeConfiguration.DynamicRegistration {
+        wanted["workspace/didChangeConfiguration"] = lsp.DidChangeConfigurationRegistrationOptions{
+            Section: config.Section,
+        }
+    }
+    // off in the settings, or while there is no compiler to run
+    if s.client.TextDocument.Completion.DynamicRegistration && s.config.Completion && !s.compilerMissing {
+        wanted["textDocument/completion"] = lsp.CompletionRegistrationOptions{}
+    }
+    return wanted
+}
+
+// updateRegistrations registers and unregisters capabilities until the
+// client has exactly the wanted ones. It does not wait for the client,
+// and as each update works out what is wanted afresh, the last one wins.
+func (s *session) updateRegistrations() {
+    go func() {
+        s.regMu.Lock()
+        defer s.regMu.Unlock()
+
+        wanted := s.wantedRegistrations()
+
+        var unregister []lsp.Unregistration
+        for _, method := range slices.Sorted(maps.Keys(s.registered)) {
+            if _, ok := wanted[method]; !ok {
+                unregister = append(unregister, lsp.Unregistration{ID: method, Method: method})
+            }
+        }
+        if len(unregister) > 0 {
+            params := lsp.UnregistrationParams{Unregisterations: unregister}
+            if err := s.conn.Call(s.ctx, "client/unregisterCapability", params, nil); err != nil {
+                s.callFailed("Could not unregister capabilities", err)
+                return
+            }
+            for _, u := range unregister {
+                delete(s.registered, u.Method)
+            }
+        }
+
+        var register []lsp.Registration
+        for _, method := range slices.Sorted(maps.Keys(wanted)) {
+            if !s.registered[method] {
+                register = append(register, lsp.Registration{
+                    ID: method,
+                    Method: method,
+                    RegisterOptions: wanted[method],
+                })
+            }
+        }
+        if len(register) > 0 {
+            params := lsp.RegistrationParams{Registrations: register}
+            if err := s.conn.Call(s.ctx, "client/registerCapability", params, nil); err != nil {
+                s.callFailed("Could not register capabilities", err)
+                return
+            }
+            for _, r := range register {
+                s.registered[r.Method] = true
+            }
+        }
+    }()
+}
+
+// watchedFilesChanged handles changes to files the client watches for us.
+func (s *session) watchedFilesChanged(changes []lsp.FileEvent) {
+    recompile := false
+    for _, change := range changes {
+        // open documents come with their own notifications, others may
+        // still be read by the compiler when it compiles the open ones
+        if _, open := s.state.Document(change.URI); !open {
+            recompile = true
+        }
+    }
+    if recompile {
+        for _, uri := range s.state.DocumentURIs() {
+            s.queueDiagnostics(uri)
+        }
+    }
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sunny-lsp/analysis"
+	"sunny-lsp/config"
+	"sunny-lsp/rpc"
+)
+
+// replayResult is what a replayed session produced, or what the trace
+// recorded, in a form that can be compared.
+type replayResult struct {
+    // responses by request id
+    responses map[rpc.ID]json.RawMessage
+    // method of each request, for reporting
+    methods map[rpc.ID]string
+    // last publishDiagnostics params per uri
+    diagnostics map[string]json.RawMessage
+}
+
+func newReplayResult() *replayResult {
+    return &replayResult{
+        responses: map[rpc.ID]json.RawMessage{},
+        methods: map[rpc.ID]string{},
+        diagnostics: map[string]json.RawMessage{},
+    }
+}
+
+// add records a server message. Progress, log and trace notifications
+// depend on timing and are not compared.
+func (r *replayResult) add(content []byte) error {
+    var msg rpc.Message
+    if err := json.Unmarshal(content, &msg); err != nil {
+        return err
+    }
+
+    switch {
+    case msg.IsResponse() && msg.ID != nil:
+        r.responses[*msg.ID] = content
+    case msg.Method == "textDocument/publishDiagnostics":
+        var params struct {
+            URI string `json:"uri"`
+        }
+        if err := json.Unmarshal(msg.Params, &params); err != nil {
+            return err
+        }
+        r.diagnostics[params.URI] = msg.Params
+    }
+    return nil
+}
+
+// runReplay implements `sunny-lsp replay <trace.jsonl>`. It feeds the
+// client messages of one recorded session through a fresh session and
+// reports every response and final diagnostic set that differs.
+func runReplay(args []string) int {
+    flags := flag.NewFlagSet("replay", flag.ExitOnError)
+    sessionID := flags.Int("session", 0, "replay session `n` of the trace (default: the first one)")
+    compilerPath := flags.String("compiler", "", "run the compiler at `path` instead of the default")
+    stub := flags.Bool("stub", false, "use a stub compiler that reports no symbols or diagnostics")
+    verbose := flags.Bool("v", false, "write the server log to stderr")
+    flags.Usage = func() {
+        fmt.Fprintf(flags.Output(), "usage: sunny-lsp replay [flags] <trace.jsonl>\n")
+        flags.PrintDefaults()
+    }
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        flags.Usage()
+        return 2
+    }
+
+    inbound, expected, err := loadTrace(flags.Arg(0), *sessionID)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "replay: %s\n", err)
+        return 1
+    }
+
+    level := new(slog.LevelVar)
+    level.Set(slog.LevelDebug)
+    logger := slog.New(slog.DiscardHandler)
+    if *verbose {
+        logger, _, _ = openLog("stderr", level)
+    }
+    var flagLayer config.Layer
+    if *compilerPath != "" {
+        flagLayer.CompilerPath = compilerPath
+    }
+    srv := &server{logger: logger, level: level, config: loadConfig(flagLayer)}
+    if *stub {
+        srv.compiler = analysis.StubCompiler{}
+    }
+
+    actual, err := srv.replay(inbound)
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "replay: %s\n", err)
+        return 1
+    }
+
+    mismatches := diffReplay(expected, actual)
+    for _, line := range mismatches {
+        fmt.Println(line)
+    }
+    if len(mismatches) > 0 {
+        fmt.Printf("%d mismatches\n", len(mismatches))
+        return 1
+    }
+    fmt.Printf("replayed %d messages, no differences\n", len(inbound))
+    return 0
+}
+
+// loadTrace returns the client messages of one session and what the
+// server sent back in the recording.
+func loadTrace(filename string, sessionID int) ([][]byte, *replayResult, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer file.Close()
+
+    var inbound [][]byte
+    expected := newReplayResult()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(nil, rpc.DefaultMaxMessageSize)
+    for line := 1; scanner.Scan(); line++ {
+        var entry traceEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            return nil, nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+        }
+        if sessionID == 0 {
+            sessionID = entry.Session
+        }
+        if entry.Session != sessionID {
+            continue
+        }
+
+        switch entry.Direction {
+        case rpc.Inbound:
+            inbound = append(inbound, entry.Message)
+            var msg rpc.Message
+            if json.Unmarshal(entry.Message, &msg) == nil && msg.IsRequest() {
+                expected.methods[*msg.ID] = msg.Method
+            }
+        case rpc.Outbound:
+            if err := expected.add(entry.Message); err != nil {
+                return nil, nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+            }
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, nil, err
+    }
+    if len(inbound) == 0 {
+        return nil, nil, errors.New("no client messages to replay")
+    }
+    return inbound, expected, nil
+}
+
+// replay runs the messages through a session over in-memory pipes, the
+// same way a client on stdio would, and collects what the server sends.
+// The input ends sooner than the recorded client did, so the session
+// finishes its requests and diagnostics before it stops.
+func (srv *server) replay(inbound [][]byte) (*replayResult, error) {
+    clientOut, serverIn := io.Pipe()
+    serverOut, clientIn := io.Pipe()
+
+    served := make(chan error, 1)
+    s := srv.newSession(rpc.NewConn(clientOut, clientIn))
+    s.finishOnClose = true
+    go func() {
+        err := s.serve()
+        clientIn.Close()
+        served <- err
+    }()
+
+    go func() {
+        for _, content := range inbound {
+            fmt.Fprintf(serverIn, "Content-Length: %d\r\n\r\n%s", len(content), content)
+        }
+        serverIn.Close()
+    }()
+
+    actual := newReplayResult()
+    reader := rpc.NewReader(serverOut)
+    for {
+        content, err := reader.ReadMessage()
+        if errors.Is(err, io.EOF) {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        if err := actual.add(content); err != nil {
+            return nil, err
+        }
+    }
+    if err := <-served; err != nil && !errors.Is(err, errExitWithoutShutdown) {
+        return nil, err
+    }
+    return actual, nil
+}
+
+// compareIDs orders numeric ids before string ones, each in their
+// natural order.
+func compareIDs(a, b rpc.ID) int {
+    if a.IsString() != b.IsString() {
+        if a.IsString() {
+            return 1
+        }
+        return -1
+    }
+    if a.IsString() {
+        return strings.Compare(a.Str, b.Str)
+    }
+    return cmp.Compare(a.Num, b.Num)
+}
+
+func diffReplay(expected, actual *replayResult) []string {
+    var mismatches []string
+    for _, id := range slices.SortedFunc(maps.Keys(expected.responses), compareIDs) {
+        want := expected.responses[id]
+        got, ok := actual.responses[id]
+        method := expected.methods[id]
+        if !ok {
+            mismatches = append(mismatches, fmt.Sprintf("request %s (%s): no response", id, method))
+            continue
+        }
+        if !jsonEqual(want, got) {
+            mismatches = append(mismatches, fmt.Sprintf("request %s (%s):\n  expected %s\n  actual   %s", id, method, want, got))
+        }
+    }
+    for _, id := range slices.SortedFunc(maps.Keys(actual.responses), compareIDs) {
+        if _, ok := expected.responses[id]; !ok {
+            mismatches = append(mismatches, fmt.Sprintf("request %s (%s): unexpected response", id, expected.methods[id]))
+        }
+    }
+
+    for _, uri := range slices.Sorted(maps.Keys(expected.diagnostics)) {
+        want := expected.diagnostics[uri]
+        got, ok := actual.diagnostics[uri]
+        if !ok {
+            mismatches = append(mismatches, fmt.Sprintf("diagnostics %s: none published", uri))
+            continue
+        }
+        if !jsonEqual(want, got) {
+            mismatches = append(mismatches, fmt.Sprintf("diagnostics %s:\n  expected %s\n  actual   %s", uri, want, got))
+        }
+    }
+    return mismatches
+}
+
+// jsonEqual compares two documents ignoring formatting and key order.
+func jsonEqual(a, b json.RawMessage) bool {
+    var va, vb any
+    if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+        return bytes.Equal(a, b)
+    }
+    ja, _ := json.Marshal(va)
+    jb, _ := json.Marshal(vb)
+    return bytes.Equal(ja, jb)
+}
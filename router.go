@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sunny-lsp/lsp"
+	"sunny-lsp/rpc"
+	"time"
+)
+
+// handlerFunc serves one message. The result is the response of a
+// request; for notifications it is dropped. Errors of type
+// *lsp.ResponseError are sent as they are, any other is an internal error.
+type handlerFunc func(ctx context.Context, msg *rpc.Message) (any, error)
+
+// middleware wraps the handler of a route.
+type middleware func(rt *route, next handlerFunc) handlerFunc
+
+type route struct {
+    method string
+    handle handlerFunc
+    // run on the read loop, so nothing after it is looked at until it is
+    // done; notifications always are
+    onReadLoop bool
+    // if set and false, the method is turned away
+    enabled func() bool
+}
+
+// readLoop makes the route run on the read loop.
+func (rt *route) readLoop() *route {
+    rt.onReadLoop = true
+    return rt
+}
+
+// when serves the route only while enabled returns true.
+func (rt *route) when(enabled func() bool) *route {
+    rt.enabled = enabled
+    return rt
+}
+
+// router finds the handler for each method and runs it through the
+// middleware, the first one added outermost.
+type router struct {
+    routes map[string]*route
+    middleware []middleware
+}
+
+func newRouter() *router {
+    return &router{routes: map[string]*route{}}
+}
+
+func (r *router) use(m ...middleware) {
+    r.middleware = append(r.middleware, m...)
+}
+
+// handle registers fn for the requests or notifications of method. Params
+// are decoded into P before fn is called; params that don't decode are
+// answered with InvalidParams.
+func handle[P, R any](r *router, method string, fn func(ctx context.Context, params P) (R, error)) *route {
+    rt := &route{method: method}
+    rt.handle = func(ctx context.Context, msg *rpc.Message) (any, error) {
+        var params P
+        if len(msg.Params) > 0 {
+            if err := json.Unmarshal(msg.Params, &params); err != nil {
+                return nil, &lsp.ResponseError{Code: lsp.InvalidParams, Message: err.Error()}
+            }
+        }
+        return fn(ctx, params)
+    }
+    r.routes[method] = rt
+    return rt
+}
+
+// notify registers a handler for a notification, which has no result.
+func notify[P any](r *router, method string, fn func(ctx context.Context, params P)) *route {
+    return handle(r, method, func(ctx context.Context, params P) (any, error) {
+        fn(ctx, params)
+        return nil, nil
+    })
+}
+
+func (r *router) route(method string) (*route, bool) {
+    rt, ok := r.routes[method]
+    return rt, ok
+}
+
+// serve runs msg through its route. Unknown methods get MethodNotFound.
+func (r *router) serve(ctx context.Context, msg *rpc.Message) (any, error) {
+    rt, ok := r.routes[msg.Method]
+    if !ok {
+        return nil, &lsp.ResponseError{
+            Code: lsp.MethodNotFound,
+            Message: fmt.Sprintf("method not found: %s", msg.Method),
+        }
+    }
+
+    h := rt.handle
+    for i := len(r.middleware) - 1; i >= 0; i-- {
+        h = r.middleware[i](rt, h)
+    }
+    return h(ctx, msg)
+}
+
+type loggerKey struct{}
+
+// log returns the logger of the message being handled, which carries
+// its method and id.
+func (s *session) log(ctx context.Context) *slog.Logger {
+    if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+        return logger
+    }
+    return s.logger
+}
+
+// logMessages gives each message a logger with its method and id, and
+// logs how long it took and how it failed.
+func (s *session) logMessages(rt *route, next handlerFunc) handlerFunc {
+    return func(ctx context.Context, msg *rpc.Message) (any, error) {
+        logger := s.logger.With("method", msg.Method)
+        if msg.IsRequest() {
+            logger = logger.With("id", msg.ID.String())
+        }
+        ctx = context.WithValue(ctx, loggerKey{}, logger)
+
+        logger.Debug("Received")
+        start := time.Now()
+        result, err := next(ctx, msg)
+        duration := time.Since(start)
+
+        switch {
+        case ctx.Err() != nil:
+            logger.Debug("Cancelled", "duration", duration)
+        case err == nil:
+            logger.Debug("Handled", "duration", duration)
+        default:
+            logger.Warn("Failed", "duration", duration, "err", err)
+        }
+        return result, err
+    }
+}
+
+// recoverPanics turns a panicking handler into an InternalError, so one
+// bad request doesn't take the whole server down. The panic is logged and
+// dumped with the document the message was about.
+func (s *session) recoverPanics(rt *route, next handlerFunc) handlerFunc {
+    return func(ctx context.Context, msg *rpc.Message) (result any, err error) {
+        defer func() {
+            if v := recover(); v != nil {
+                var params struct {
+                    TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+                }
+                json.Unmarshal(msg.Params, &params)
+                s.crashed(msg.Method, params.TextDocument.URI, v)
+
+                result, err = nil, &lsp.ResponseError{
+                    Code: lsp.InternalError,
+                    Message: fmt.Sprintf("internal error in %s: %v", msg.Method, v),
+                }
+            }
+        }()
+        return next(ctx, msg)
+    }
+}
+
+// gateCapabilities turns away methods whose route is disabled, e.g.
+// because the client can't use the result or the settings turned it off.
+func (s *session) gateCapabilities(rt *route, next handlerFunc) handlerFunc {
+    if rt.enabled == nil {
+        return next
+    }
+    return func(ctx context.Context, msg *rpc.Message) (any, error) {
+        if !rt.enabled() {
+            name, _ := strings.CutPrefix(rt.method, "textDocument/")
+            return nil, &lsp.ResponseError{
+                Code: lsp.RequestFailed,
+                Message: fmt.Sprintf("%s is disabled", name),
+            }
+        }
+        return next(ctx, msg)
+    }
+}
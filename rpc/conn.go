@@ -0,0 +1,328 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+    codeParseError = -32700
+    codeInvalidRequest = -32600
+)
+
+var ErrClosed = errors.New("connection closed")
+
+// Message is any JSON-RPC message: a request has a Method and an ID, a
+// notification only a Method, and a response only an ID.
+type Message struct {
+    RPC string `json:"jsonrpc"`
+    ID *ID `json:"id,omitempty"`
+    Method string `json:"method,omitempty"`
+    Params json.RawMessage `json:"params,omitempty"`
+    Result json.RawMessage `json:"result,omitempty"`
+    Error *Error `json:"error,omitempty"`
+
+    // Content is the body the message was decoded from
+    Content []byte `json:"-"`
+}
+
+func (m *Message) IsRequest() bool {
+    return m.Method != "" && m.ID != nil
+}
+
+func (m *Message) IsNotification() bool {
+    return m.Method != "" && m.ID == nil
+}
+
+func (m *Message) IsResponse() bool {
+    return m.Method == ""
+}
+
+// Error is the error object of a response.
+type Error struct {
+    Code int `json:"code"`
+    Message string `json:"message"`
+    Data json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+    return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// Direction tells whether a traced message was received or sent.
+type Direction string
+
+const (
+    Inbound Direction = "in"
+    Outbound Direction = "out"
+)
+
+// Conn is a bidirectional JSON-RPC connection. Incoming requests and
+// notifications are passed to the handler given to Run; responses are
+// matched to the outgoing requests made with Call.
+type Conn struct {
+    reader *Reader
+    writer *Writer
+
+    mu sync.Mutex
+    nextID int
+    pending map[ID]chan *Message
+    closed bool
+    stop chan struct{}
+    stopOnce sync.Once
+
+    // OnError is called for messages that could not be read or decoded
+    // but did not break the stream
+    OnError func(err error)
+
+    // Trace, if set, is called with the body of every message read or
+    // written, before it is decoded or after it is encoded
+    Trace func(dir Direction, content []byte)
+}
+
+func NewConn(r io.Reader, w io.Writer) *Conn {
+    return &Conn{
+        reader: NewReader(r),
+        writer: NewWriter(w),
+        pending: map[ID]chan *Message{},
+        stop: make(chan struct{}),
+    }
+}
+
+// SetMaxMessageSize limits the size of the messages read, see
+// Reader.MaxMessageSize. It must be called before Run.
+func (c *Conn) SetMaxMessageSize(n int) {
+    c.reader.MaxMessageSize = n
+}
+
+// Run reads messages until the stream ends, Close is called, or a write
+// fails, in which case the write error is returned. The handler is called for each message
+// in order, so it must not wait on Call itself.
+func (c *Conn) Run(handler func(msg *Message)) error {
+    defer c.close()
+
+    messages := make(chan *Message)
+    readErr := make(chan error, 1)
+    stopped := make(chan struct{})
+    defer close(stopped)
+
+    go func() {
+        readErr <- c.read(messages, stopped)
+    }()
+
+    for {
+        select {
+        case msg := <-messages:
+            handler(msg)
+        case err := <-readErr:
+            return err
+        case <-c.writer.Done():
+            return c.writer.Err()
+        case <-c.stop:
+            return nil
+        }
+    }
+}
+
+// Close makes Run return without waiting for the stream to end. The
+// underlying reader and writer are not closed.
+func (c *Conn) Close() {
+    c.stopOnce.Do(func() {
+        close(c.stop)
+    })
+}
+
+// read decodes messages onto messages until the stream ends or Run stops
+// listening. Responses are delivered to their callers directly.
+func (c *Conn) read(messages chan<- *Message, stopped <-chan struct{}) error {
+    for {
+        content, err := c.reader.ReadMessage()
+        if err != nil {
+            if errors.Is(err, io.EOF) {
+                return nil
+            }
+            if errors.Is(err, ErrMessageTooLarge) {
+                c.reportError(err)
+                continue
+            }
+            return err
+        }
+        if c.Trace != nil {
+            c.Trace(Inbound, content)
+        }
+
+        if !json.Valid(content) {
+            c.reportError(fmt.Errorf("invalid JSON: %s", content))
+            c.ReplyError(nil, &Error{Code: codeParseError, Message: "invalid JSON"})
+            continue
+        }
+        var msg Message
+        err = json.Unmarshal(content, &msg)
+        if err == nil && msg.Method == "" && msg.Result == nil && msg.Error == nil {
+            err = errors.New("neither a request, a notification nor a response")
+        }
+        if err != nil {
+            c.reportError(fmt.Errorf("invalid message: %w", err))
+            c.ReplyError(readableID(content), &Error{Code: codeInvalidRequest, Message: err.Error()})
+            continue
+        }
+        msg.Content = content
+
+        if msg.IsResponse() {
+            c.deliver(&msg)
+            continue
+        }
+
+        select {
+        case messages <- &msg:
+        case <-stopped:
+            return nil
+        }
+    }
+}
+
+// Call sends a request and waits for its response, decoding the result
+// into result unless it is nil. An error response is returned as *Error.
+// If ctx is done first the request is cancelled with $/cancelRequest.
+func (c *Conn) Call(ctx context.Context, method string, params, result any) error {
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return ErrClosed
+    }
+    c.nextID++
+    id := NumberID(c.nextID)
+    ch := make(chan *Message, 1)
+    c.pending[id] = ch
+    c.mu.Unlock()
+
+    request := struct {
+        RPC string `json:"jsonrpc"`
+        ID ID `json:"id"`
+        Method string `json:"method"`
+        Params any `json:"params,omitempty"`
+    }{"2.0", id, method, params}
+
+    if err := c.Write(request); err != nil {
+        c.forget(id)
+        return err
+    }
+
+    select {
+    case response, ok := <-ch:
+        if !ok {
+            return ErrClosed
+        }
+        if response.Error != nil {
+            return response.Error
+        }
+        if result == nil || len(response.Result) == 0 {
+            return nil
+        }
+        return json.Unmarshal(response.Result, result)
+    case <-ctx.Done():
+        c.forget(id)
+        c.Notify("$/cancelRequest", map[string]ID{"id": id})
+        return ctx.Err()
+    }
+}
+
+func (c *Conn) Notify(method string, params any) error {
+    return c.Write(struct {
+        RPC string `json:"jsonrpc"`
+        Method string `json:"method"`
+        Params any `json:"params,omitempty"`
+    }{"2.0", method, params})
+}
+
+func (c *Conn) Reply(id *ID, result any) error {
+    return c.Write(struct {
+        RPC string `json:"jsonrpc"`
+        ID *ID `json:"id"`
+        Result any `json:"result"`
+    }{"2.0", id, result})
+}
+
+// ReplyError answers a request with an error object, such as *Error or
+// any other type that marshals to {code, message, data}.
+func (c *Conn) ReplyError(id *ID, rerr any) error {
+    return c.Write(struct {
+        RPC string `json:"jsonrpc"`
+        ID *ID `json:"id"`
+        Error any `json:"error"`
+    }{"2.0", id, rerr})
+}
+
+// Write sends a complete message. Writes from several goroutines never
+// interleave.
+func (c *Conn) Write(msg any) error {
+    content, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+
+    var trace func(content []byte)
+    if c.Trace != nil {
+        trace = func(content []byte) {
+            c.Trace(Outbound, content)
+        }
+    }
+    return c.writer.writeContent(content, trace)
+}
+
+// readableID is the id of a message that is otherwise invalid, if it has
+// one, so the error reply reaches the request.
+func readableID(content []byte) *ID {
+    var msg struct {
+        ID *ID `json:"id"`
+    }
+    if json.Unmarshal(content, &msg) != nil {
+        return nil
+    }
+    return msg.ID
+}
+
+func (c *Conn) deliver(msg *Message) {
+    if msg.ID == nil {
+        c.reportError(fmt.Errorf("response without id: %s", msg.Content))
+        return
+    }
+
+    c.mu.Lock()
+    ch, ok := c.pending[*msg.ID]
+    delete(c.pending, *msg.ID)
+    c.mu.Unlock()
+
+    if !ok {
+        c.reportError(fmt.Errorf("response to unknown request %s", msg.ID))
+        return
+    }
+    ch <- msg
+}
+
+func (c *Conn) forget(id ID) {
+    c.mu.Lock()
+    delete(c.pending, id)
+    c.mu.Unlock()
+}
+
+func (c *Conn) close() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.closed = true
+    for id, ch := range c.pending {
+        close(ch)
+        delete(c.pending, id)
+    }
+}
+
+func (c *Conn) reportError(err error) {
+    if c.OnError != nil {
+        c.OnError(err)
+    }
+}
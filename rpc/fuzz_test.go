@@ -0,0 +1,201 @@
+package rpc_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sunny-lsp/rpc"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+func frame(body string) string {
+    return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+var seedFrames = []string{
+    frame(`{"method":"hi"}`),
+    frame(`{"method":"hi"}`) + frame(`{"jsonrpc":"2.0","id":1,"method":"initialize"}`),
+    "Content-Type: application/vscode-jsonrpc; charset=utf-8\r\n" + frame(`{}`),
+    "content-length: 2\r\ncontent-type: application/vscode-jsonrpc; charset=utf8\r\n\r\n{}",
+    "Content-Length: 10\r\n\r\n{}",
+    "Content-Length: -5\r\n\r\n{}",
+    "Content-Length: 99999999999999999999999\r\n\r\n{}",
+    "Content-Length: 1099511627776\r\n\r\n{}",
+    "Content-Length:\r\n\r\n",
+    "X\r\n\r\n",
+    "\r\n\r\n",
+    "Content-Length: 2",
+    "",
+}
+
+func FuzzSplit(f *testing.F) {
+    for _, seed := range seedFrames {
+        f.Add([]byte(seed), false)
+        f.Add([]byte(seed), true)
+    }
+
+    f.Fuzz(func(t *testing.T, data []byte, atEOF bool) {
+        advance, token, err := rpc.Split(data, atEOF)
+        if err != nil {
+            return
+        }
+        if advance < 0 || advance > len(data) || advance != len(token) {
+            t.Fatalf("advance %d, token %d bytes, data %d bytes", advance, len(token), len(data))
+        }
+        if token == nil {
+            return
+        }
+        if !bytes.Equal(token, data[:advance]) {
+            t.Fatalf("token is not a prefix of data")
+        }
+        // whatever Split frames, DecodeMessage must handle without panicking
+        rpc.DecodeMessage(token)
+    })
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+    for _, seed := range seedFrames {
+        f.Add([]byte(seed))
+    }
+
+    f.Fuzz(func(t *testing.T, msg []byte) {
+        _, content, err := rpc.DecodeMessage(msg)
+        if err == nil && len(content) > len(msg) {
+            t.Fatalf("content of %d bytes from a %d byte message", len(content), len(msg))
+        }
+    })
+}
+
+func FuzzReader(f *testing.F) {
+    for _, seed := range seedFrames {
+        f.Add([]byte(seed))
+    }
+
+    f.Fuzz(func(t *testing.T, stream []byte) {
+        reader := rpc.NewReader(bytes.NewReader(stream))
+        reader.MaxMessageSize = 1 << 10
+
+        // every successful read consumes at least the header, so the
+        // number of reads is bounded by the stream length
+        for reads := 0; reads <= len(stream); reads++ {
+            content, err := reader.ReadMessage()
+            if errors.Is(err, rpc.ErrMessageTooLarge) {
+                continue
+            }
+            if err != nil {
+                return
+            }
+            if len(content) > reader.MaxMessageSize {
+                t.Fatalf("read %d bytes over the limit", len(content))
+            }
+        }
+        t.Fatalf("reader did not stop on a %d byte stream", len(stream))
+    })
+}
+
+// Every prefix of a valid stream must either ask for more data or yield
+// exactly the first message.
+func TestSplitEveryBoundary(t *testing.T) {
+    first := frame(`{"method":"first"}`)
+    stream := []byte(first + frame(`{"method":"second"}`))
+
+    for i := 0; i <= len(stream); i++ {
+        advance, token, err := rpc.Split(stream[:i], false)
+        if err != nil {
+            t.Fatalf("prefix %d: %v", i, err)
+        }
+        if i < len(first) && (advance != 0 || token != nil) {
+            t.Fatalf("prefix %d: framed %q before the message was complete", i, token)
+        }
+        if i >= len(first) && string(token) != first {
+            t.Fatalf("prefix %d: Expected %q, Actual %q", i, first, token)
+        }
+    }
+}
+
+func TestSplitOneByteReads(t *testing.T) {
+    bodies := []string{`{"method":"a"}`, `{"method":"b","params":{"text":"` + strings.Repeat("x", 300) + `"}}`, `{}`}
+    var stream strings.Builder
+    for _, body := range bodies {
+        stream.WriteString(frame(body))
+    }
+
+    scanner := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(stream.String())))
+    scanner.Split(rpc.Split)
+    reader := rpc.NewReader(iotest.OneByteReader(strings.NewReader(stream.String())))
+
+    for _, body := range bodies {
+        if !scanner.Scan() {
+            t.Fatalf("Scanner stopped early: %v", scanner.Err())
+        }
+        _, content, err := rpc.DecodeMessage(scanner.Bytes())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if string(content) != body {
+            t.Fatalf("Scanner: Expected %s, Actual %s", body, content)
+        }
+
+        content, err = reader.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if string(content) != body {
+            t.Fatalf("Reader: Expected %s, Actual %s", body, content)
+        }
+    }
+    if scanner.Scan() {
+        t.Fatalf("Scanner framed trailing data %q", scanner.Bytes())
+    }
+    if _, err := reader.ReadMessage(); err != io.EOF {
+        t.Fatalf("Expected EOF, Actual %v", err)
+    }
+}
+
+type roundTripMessage struct {
+    Method string `json:"method"`
+    ID int `json:"id"`
+    Text string `json:"text"`
+    Values []float64 `json:"values"`
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+    roundTrip := func(msg roundTripMessage) bool {
+        encoded, err := rpc.EncodeMessage(msg)
+        if err != nil {
+            return false
+        }
+
+        method, content, err := rpc.DecodeMessage([]byte(encoded))
+        if err != nil || method != msg.Method {
+            return false
+        }
+
+        // the stream reader and Split must agree with DecodeMessage
+        read, err := rpc.NewReader(strings.NewReader(encoded + encoded)).ReadMessage()
+        if err != nil || !bytes.Equal(read, content) {
+            return false
+        }
+        advance, token, err := rpc.Split([]byte(encoded+encoded), false)
+        if err != nil || advance != len(encoded) || string(token) != encoded {
+            return false
+        }
+
+        var decoded roundTripMessage
+        if err := json.Unmarshal(content, &decoded); err != nil {
+            return false
+        }
+        reencoded, _ := rpc.EncodeMessage(decoded)
+        return reencoded == encoded
+    }
+
+    if err := quick.Check(roundTrip, nil); err != nil {
+        t.Fatal(err)
+    }
+}
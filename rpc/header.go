@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+const DefaultContentType = "application/vscode-jsonrpc; charset=utf-8"
+
+var (
+    ErrMalformedHeader      = errors.New("malformed header line")
+    ErrMissingContentLength = errors.New("missing Content-Length header")
+    ErrInvalidContentLength = errors.New("invalid Content-Length")
+    ErrUnsupportedCharset   = errors.New("unsupported charset")
+)
+
+// Header is the parsed header block that precedes every message body.
+type Header struct {
+    ContentLength int
+    ContentType string
+}
+
+// HeaderError reports which header line could not be parsed and why.
+type HeaderError struct {
+    Line string
+    Err error
+}
+
+func (e *HeaderError) Error() string {
+    return fmt.Sprintf("header %q: %v", e.Line, e.Err)
+}
+
+func (e *HeaderError) Unwrap() error {
+    return e.Err
+}
+
+// ParseHeader parses a header block (without the trailing blank line).
+// Header names are matched case-insensitively and may come in any order;
+// unknown headers are ignored.
+func ParseHeader(block []byte) (Header, error) {
+    header := Header{
+        ContentLength: -1,
+        ContentType: DefaultContentType,
+    }
+
+    for len(block) > 0 {
+        var line []byte
+        line, block, _ = bytes.Cut(block, []byte{'\r', '\n'})
+        if len(line) == 0 {
+            continue
+        }
+        if err := header.parseLine(string(line)); err != nil {
+            return Header{}, err
+        }
+    }
+
+    if header.ContentLength < 0 {
+        return Header{}, ErrMissingContentLength
+    }
+    return header, nil
+}
+
+func (h *Header) parseLine(line string) error {
+    name, value, found := strings.Cut(line, ":")
+    if !found || strings.TrimSpace(name) == "" {
+        return &HeaderError{Line: line, Err: ErrMalformedHeader}
+    }
+    name = strings.TrimSpace(name)
+    value = strings.TrimSpace(value)
+
+    switch {
+    case strings.EqualFold(name, "Content-Length"):
+        length, err := strconv.Atoi(value)
+        if err != nil || length < 0 {
+            return &HeaderError{Line: line, Err: ErrInvalidContentLength}
+        }
+        if h.ContentLength >= 0 && h.ContentLength != length {
+            return &HeaderError{Line: line, Err: ErrInvalidContentLength}
+        }
+        h.ContentLength = length
+    case strings.EqualFold(name, "Content-Type"):
+        _, params, err := mime.ParseMediaType(value)
+        if err != nil {
+            return &HeaderError{Line: line, Err: err}
+        }
+        // "utf8" is still accepted for backwards compatibility
+        if charset, ok := params["charset"]; ok &&
+            !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+            return &HeaderError{Line: line, Err: fmt.Errorf("%w: %s", ErrUnsupportedCharset, charset)}
+        }
+        h.ContentType = value
+    }
+    return nil
+}
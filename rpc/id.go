@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ID is a request id. JSON-RPC allows numbers and strings; the requests
+// a Conn makes itself use numbers. IDs are comparable, so they can key
+// maps of requests.
+type ID struct {
+    Num int
+    Str string
+    // set for string ids, so "" and 0 stay apart
+    isStr bool
+}
+
+func NumberID(n int) ID {
+    return ID{Num: n}
+}
+
+func StringID(s string) ID {
+    return ID{Str: s, isStr: true}
+}
+
+func (id ID) IsString() bool {
+    return id.isStr
+}
+
+// String is the id as it appears in JSON.
+func (id ID) String() string {
+    if id.isStr {
+        return strconv.Quote(id.Str)
+    }
+    return strconv.Itoa(id.Num)
+}
+
+func (id ID) MarshalJSON() ([]byte, error) {
+    if id.isStr {
+        return json.Marshal(id.Str)
+    }
+    return json.Marshal(id.Num)
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+    if len(data) > 0 && data[0] == '"' {
+        var s string
+        if err := json.Unmarshal(data, &s); err != nil {
+            return err
+        }
+        *id = StringID(s)
+        return nil
+    }
+    var n int
+    if err := json.Unmarshal(data, &n); err != nil {
+        return fmt.Errorf("id must be an integer or a string: %s", data)
+    }
+    *id = NumberID(n)
+    return nil
+}
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+    DefaultMaxMessageSize = 32 << 20
+    maxHeaderSize = 8 << 10
+)
+
+var (
+    ErrMessageTooLarge = errors.New("message too large")
+    ErrHeaderTooLarge  = errors.New("header block too large")
+)
+
+// Reader reads framed messages from a stream. Unlike bufio.Scanner with
+// Split it has no fixed token size: each body is read with exactly
+// Content-Length bytes, up to MaxMessageSize.
+type Reader struct {
+    r *bufio.Reader
+
+    // MaxMessageSize limits the size of a single message body in bytes.
+    // Larger messages are skipped and reported with ErrMessageTooLarge.
+    MaxMessageSize int
+}
+
+func NewReader(r io.Reader) *Reader {
+    return &Reader{
+        r: bufio.NewReader(r),
+        MaxMessageSize: DefaultMaxMessageSize,
+    }
+}
+
+// ReadMessage returns the body of the next message.
+//
+// io.EOF is returned when the stream ends cleanly between messages. A
+// message over MaxMessageSize is discarded and reported with an error
+// wrapping ErrMessageTooLarge; the reader stays in sync, so the caller can
+// keep reading. Any other error leaves the stream in an unknown state.
+func (r *Reader) ReadMessage() ([]byte, error) {
+    block, err := r.readHeaderBlock()
+    if err != nil {
+        return nil, err
+    }
+
+    header, err := ParseHeader(block)
+    if err != nil {
+        return nil, err
+    }
+
+    if header.ContentLength > r.MaxMessageSize {
+        if _, err := io.CopyN(io.Discard, r.r, int64(header.ContentLength)); err != nil {
+            return nil, unexpectedEOF(err)
+        }
+        return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d",
+            ErrMessageTooLarge, header.ContentLength, r.MaxMessageSize)
+    }
+
+    content := make([]byte, header.ContentLength)
+    if _, err := io.ReadFull(r.r, content); err != nil {
+        return nil, unexpectedEOF(err)
+    }
+    return content, nil
+}
+
+// readHeaderBlock reads header lines up to and excluding the blank line.
+func (r *Reader) readHeaderBlock() ([]byte, error) {
+    var block []byte
+    for {
+        line, err := r.r.ReadSlice('\n')
+        if err != nil {
+            if err == io.EOF && len(block) == 0 && len(line) == 0 {
+                return nil, io.EOF
+            }
+            if err == bufio.ErrBufferFull {
+                return nil, ErrHeaderTooLarge
+            }
+            return nil, unexpectedEOF(err)
+        }
+
+        if string(line) == "\r\n" {
+            return block, nil
+        }
+
+        block = append(block, line...)
+        if len(block) > maxHeaderSize {
+            return nil, ErrHeaderTooLarge
+        }
+    }
+}
+
+func unexpectedEOF(err error) error {
+    if err == io.EOF {
+        return io.ErrUnexpectedEOF
+    }
+    return err
+}
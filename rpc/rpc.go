@@ -5,61 +5,81 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
+	"io"
 )
 
-func EncodeMessage(msg any) string {
+func EncodeMessage(msg any) (string, error) {
     content, err := json.Marshal(msg)
     if err != nil {
-        panic(err)
+        return "", err
     }
 
-    return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(content), content)
+    return fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(content), content), nil
 }
 
 type BaseMessage struct {
     Method string `json:"method"`
 }
 
+var ErrTruncatedContent = errors.New("content shorter than Content-Length")
+
+var separator = []byte{'\r', '\n', '\r', '\n'}
+
 func DecodeMessage(msg []byte) (string, []byte, error) {
-    header, content, found := bytes.Cut(msg, []byte{'\r', '\n', '\r', '\n'})
+    headerBlock, content, found := bytes.Cut(msg, separator)
     if !found {
         return "", nil, errors.New("Did not find separator");
     }
 
-    // Content-length: <number>
-    contentLengthBytes := header[len("Content-Length: "):] // slice
-    contentLength, err := strconv.Atoi(string(contentLengthBytes))
+    header, err := ParseHeader(headerBlock)
     if err != nil {
         return "", nil, err
     }
+    if len(content) < header.ContentLength {
+        return "", nil, ErrTruncatedContent
+    }
 
-    var baseMessage BaseMessage
-    if err := json.Unmarshal(content[:contentLength], &baseMessage); err != nil {
+    method, err := DecodeMethod(content[:header.ContentLength])
+    if err != nil {
         return "", nil, err
     }
 
-    return baseMessage.Method, content[:contentLength], nil
+    return method, content[:header.ContentLength], nil
+}
+
+// DecodeMethod returns the method of a message body read without its
+// header, e.g. by Reader.
+func DecodeMethod(content []byte) (string, error) {
+    var baseMessage BaseMessage
+    if err := json.Unmarshal(content, &baseMessage); err != nil {
+        return "", err
+    }
+
+    return baseMessage.Method, nil
 }
 
-func Split(data []byte, _ bool) (advance int, token []byte, err error) {
-    header, content, found := bytes.Cut(data, []byte{'\r', '\n', '\r', '\n'})
+func Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+    headerBlock, content, found := bytes.Cut(data, separator)
     if ! found {
+        if atEOF && len(data) > 0 {
+            return 0, nil, io.ErrUnexpectedEOF
+        }
         return 0, nil, nil
     }
 
-    // Content-length: <number>
-    contentLengthBytes := header[len("Content-Length: "):]
-    contentLength, err := strconv.Atoi(string(contentLengthBytes))
+    header, err := ParseHeader(headerBlock)
     if err != nil {
         return 0, nil, err
     }
 
-    if len(content) < contentLength {
+    if len(content) < header.ContentLength {
+        if atEOF {
+            return 0, nil, io.ErrUnexpectedEOF
+        }
         return 0, nil, nil
     }
 
     // +4 for the \r\n\r\n
-    totalLength := len(header) + 4 + contentLength
+    totalLength := len(headerBlock) + 4 + header.ContentLength
     return totalLength, data[:totalLength], nil
 }
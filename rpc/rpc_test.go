@@ -1,6 +1,13 @@
 package rpc_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
 	"sunny-lsp/rpc"
 	"testing"
 )
@@ -11,7 +18,10 @@ type EncodingExample struct {
 
 func TestEncode(t *testing.T) {
     expected := "Content-Length: 16\r\n\r\n{\"Testing\":true}"
-    actual := rpc.EncodeMessage(EncodingExample{Testing: true})
+    actual, err := rpc.EncodeMessage(EncodingExample{Testing: true})
+    if err != nil {
+        t.Fatal(err)
+    }
     if expected != actual {
         t.Fatalf("Expected %s, Actual: %s", expected, actual)
     }
@@ -31,3 +41,268 @@ func TestDecode(t *testing.T) {
         t.Fatalf("Expected 'hi', Actual %s", method)
     }
 }
+
+func TestDecodeMultipleHeaders(t *testing.T) {
+    incomingMsg := "content-type: application/vscode-jsonrpc; charset=utf-8\r\nCONTENT-LENGTH: 15\r\n\r\n{\"Method\":\"hi\"}"
+    method, content, err := rpc.DecodeMessage([]byte(incomingMsg))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(content) != 15 {
+        t.Fatalf("Expected 15, Actual %d", len(content))
+    }
+    if method != "hi" {
+        t.Fatalf("Expected 'hi', Actual %s", method)
+    }
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+    cases := map[string]error{
+        "Content-Type: application/vscode-jsonrpc": rpc.ErrMissingContentLength,
+        "Content-Length: -1": rpc.ErrInvalidContentLength,
+        "Content-Length: 10\r\nContent-Length: 11": rpc.ErrInvalidContentLength,
+        "Content-Length": rpc.ErrMalformedHeader,
+        "Content-Length: 2\r\nContent-Type: text/plain; charset=latin1": rpc.ErrUnsupportedCharset,
+    }
+    for block, expected := range cases {
+        _, err := rpc.ParseHeader([]byte(block))
+        if !errors.Is(err, expected) {
+            t.Errorf("%q: Expected %v, Actual %v", block, expected, err)
+        }
+    }
+}
+
+func TestSplitShortHeader(t *testing.T) {
+    advance, token, err := rpc.Split([]byte("X\r\n\r\n{}"), false)
+    if err == nil {
+        t.Fatalf("Expected error, Actual advance %d token %q", advance, token)
+    }
+
+    _, _, err = rpc.Split([]byte("Content-Length: 10\r\n\r\n{}"), true)
+    if !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Fatalf("Expected unexpected EOF, Actual %v", err)
+    }
+}
+
+func TestReaderLargeMessage(t *testing.T) {
+    body := "{\"text\":\"" + strings.Repeat("a", 200_000) + "\"}"
+    stream := "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body +
+        "Content-Length: 15\r\n\r\n{\"Method\":\"hi\"}"
+
+    reader := rpc.NewReader(strings.NewReader(stream))
+    content, err := reader.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(content) != body {
+        t.Fatalf("Expected body of length %d, Actual %d", len(body), len(content))
+    }
+
+    content, err = reader.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(content) != "{\"Method\":\"hi\"}" {
+        t.Fatalf("Expected second message, Actual %s", content)
+    }
+
+    if _, err := reader.ReadMessage(); err != io.EOF {
+        t.Fatalf("Expected EOF, Actual %v", err)
+    }
+}
+
+func TestReaderMessageTooLarge(t *testing.T) {
+    stream := "Content-Length: 20\r\n\r\n{\"Method\":\"toolong\"}" +
+        "Content-Length: 15\r\n\r\n{\"Method\":\"hi\"}"
+
+    reader := rpc.NewReader(strings.NewReader(stream))
+    reader.MaxMessageSize = 16
+    if _, err := reader.ReadMessage(); !errors.Is(err, rpc.ErrMessageTooLarge) {
+        t.Fatalf("Expected ErrMessageTooLarge, Actual %v", err)
+    }
+
+    content, err := reader.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(content) != "{\"Method\":\"hi\"}" {
+        t.Fatalf("Expected next message after skip, Actual %s", content)
+    }
+}
+
+func TestConnCall(t *testing.T) {
+    clientIn, serverOut := io.Pipe()
+    serverIn, clientOut := io.Pipe()
+
+    conn := rpc.NewConn(serverIn, serverOut)
+    notified := make(chan string, 1)
+    go conn.Run(func(msg *rpc.Message) {
+        notified <- msg.Method
+    })
+
+    type callResult struct {
+        Title string `json:"title"`
+    }
+    done := make(chan error, 1)
+    var result callResult
+    go func() {
+        done <- conn.Call(context.Background(), "window/showMessageRequest", map[string]string{"message": "hi"}, &result)
+    }()
+
+    client := rpc.NewReader(clientIn)
+    content, err := client.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var request rpc.Message
+    if err := json.Unmarshal(content, &request); err != nil {
+        t.Fatal(err)
+    }
+    if !request.IsRequest() || request.Method != "window/showMessageRequest" {
+        t.Fatalf("Expected request, Actual %s", content)
+    }
+
+    response := fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":{"title":"Retry"}}`, request.ID)
+    notification := `{"jsonrpc":"2.0","method":"initialized","params":{}}`
+    io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(response), response))
+    io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(notification), notification))
+
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if result.Title != "Retry" {
+        t.Fatalf("Expected 'Retry', Actual %s", result.Title)
+    }
+    if method := <-notified; method != "initialized" {
+        t.Fatalf("Expected 'initialized', Actual %s", method)
+    }
+    clientOut.Close()
+}
+
+func TestEncodeError(t *testing.T) {
+    if _, err := rpc.EncodeMessage(make(chan int)); err == nil {
+        t.Fatal("Expected error for unencodable message")
+    }
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+    return 0, io.ErrClosedPipe
+}
+
+func TestWriterBreaks(t *testing.T) {
+    writer := rpc.NewWriter(failingWriter{})
+    err := writer.WriteMessage(EncodingExample{Testing: true})
+    if !errors.Is(err, rpc.ErrWriteFailed) || !errors.Is(err, io.ErrClosedPipe) {
+        t.Fatalf("Expected failed write, Actual %v", err)
+    }
+
+    select {
+    case <-writer.Done():
+    default:
+        t.Fatal("Expected Done to be closed")
+    }
+    if err := writer.WriteMessage(EncodingExample{}); !errors.Is(err, rpc.ErrWriteFailed) {
+        t.Fatalf("Expected later writes to fail, Actual %v", err)
+    }
+}
+
+func TestIDs(t *testing.T) {
+    for _, input := range []string{`1`, `"abc"`, `""`, `0`} {
+        var id rpc.ID
+        if err := json.Unmarshal([]byte(input), &id); err != nil {
+            t.Fatalf("%s: %v", input, err)
+        }
+        output, _ := json.Marshal(id)
+        if string(output) != input {
+            t.Fatalf("Expected %s, Actual %s", input, output)
+        }
+    }
+    if rpc.StringID("") == rpc.NumberID(0) {
+        t.Fatal("Expected \"\" and 0 to differ")
+    }
+    var id rpc.ID
+    if err := json.Unmarshal([]byte(`1.5`), &id); err == nil {
+        t.Fatal("Expected an error for a fractional id")
+    }
+}
+
+// Broken JSON is a parse error; JSON that isn't a message is an invalid
+// request, answered with its id when it can be read.
+func TestConnInvalidMessages(t *testing.T) {
+    clientIn, serverOut := io.Pipe()
+    serverIn, clientOut := io.Pipe()
+
+    conn := rpc.NewConn(serverIn, serverOut)
+    handled := make(chan *rpc.Message, 1)
+    go conn.Run(func(msg *rpc.Message) {
+        handled <- msg
+    })
+
+    tests := []struct {
+        input string
+        expected string
+    }{
+        {`{"id":1,`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"invalid JSON"}}`},
+        {`[1,2]`, `"id":null,"error":{"code":-32600`},
+        {`{"jsonrpc":"2.0","id":"abc","method":7}`, `"id":"abc","error":{"code":-32600`},
+        {`{"jsonrpc":"2.0","id":4}`, `"id":4,"error":{"code":-32600`},
+    }
+    client := rpc.NewReader(clientIn)
+    for _, test := range tests {
+        io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(test.input), test.input))
+        content, err := client.ReadMessage()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !strings.Contains(string(content), test.expected) {
+            t.Fatalf("%s: Expected %s, Actual %s", test.input, test.expected, content)
+        }
+    }
+
+    request := `{"jsonrpc":"2.0","id":"abc","method":"initialize"}`
+    io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(request), request))
+    msg := <-handled
+    if !msg.IsRequest() || *msg.ID != rpc.StringID("abc") {
+        t.Fatalf("Expected a request with id \"abc\", Actual %s", msg.Content)
+    }
+    go conn.Reply(msg.ID, nil)
+    content, err := client.ReadMessage()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(content) != `{"jsonrpc":"2.0","id":"abc","result":null}` {
+        t.Fatalf("Expected the reply to keep the id, Actual %s", content)
+    }
+    clientOut.Close()
+}
+
+func TestConnMaxMessageSize(t *testing.T) {
+    serverIn, clientOut := io.Pipe()
+    conn := rpc.NewConn(serverIn, io.Discard)
+    conn.SetMaxMessageSize(32)
+    errs := make(chan error, 1)
+    conn.OnError = func(err error) {
+        errs <- err
+    }
+    handled := make(chan string, 1)
+    go conn.Run(func(msg *rpc.Message) {
+        handled <- msg.Method
+    })
+
+    long := `{"jsonrpc":"2.0","method":"` + strings.Repeat("a", 32) + `"}`
+    short := `{"method":"hi"}`
+    go func() {
+        io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(long), long))
+        io.WriteString(clientOut, fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(short), short))
+    }()
+
+    if err := <-errs; !errors.Is(err, rpc.ErrMessageTooLarge) {
+        t.Fatalf("Expected ErrMessageTooLarge, Actual %v", err)
+    }
+    if method := <-handled; method != "hi" {
+        t.Fatalf("Expected 'hi', Actual %s", method)
+    }
+    clientOut.Close()
+}
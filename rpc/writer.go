@@ -0,0 +1,71 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var ErrWriteFailed = errors.New("write failed")
+
+// Writer frames messages onto a stream. It is safe for concurrent use;
+// each message is written whole, so frames never interleave.
+//
+// Once a write fails the Writer is broken: every later write returns the
+// same error and Done is closed, so the owner can shut down.
+type Writer struct {
+    mu sync.Mutex
+    w io.Writer
+    err error
+    done chan struct{}
+}
+
+func NewWriter(w io.Writer) *Writer {
+    return &Writer{
+        w: w,
+        done: make(chan struct{}),
+    }
+}
+
+func (w *Writer) WriteMessage(msg any) error {
+    content, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    return w.writeContent(content, nil)
+}
+
+// writeContent frames an encoded body. trace, if set, is called under
+// the lock so traced messages are in the same order as on the wire.
+func (w *Writer) writeContent(content []byte, trace func(content []byte)) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.err != nil {
+        return w.err
+    }
+    if trace != nil {
+        trace(content)
+    }
+
+    if _, err := fmt.Fprintf(w.w, "Content-Length: %d\r\n\r\n%s", len(content), content); err != nil {
+        w.err = fmt.Errorf("%w: %w", ErrWriteFailed, err)
+        close(w.done)
+        return w.err
+    }
+    return nil
+}
+
+// Done is closed after the first failed write.
+func (w *Writer) Done() <-chan struct{} {
+    return w.done
+}
+
+// Err returns the error that broke the Writer, if any.
+func (w *Writer) Err() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    return w.err
+}
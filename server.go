@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sunny-lsp/analysis"
+	"sunny-lsp/config"
+	"sunny-lsp/lsp"
+	"sunny-lsp/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// server holds what is shared by all sessions of one process.
+type server struct {
+    logger *slog.Logger
+    // shared by every session, the client settings can change it
+    level *slog.LevelVar
+    // defaults, environment and flags; clients layer their settings on top
+    config config.Config
+    tracer *traceRecorder // nil unless a trace file was requested
+    compiler analysis.Compiler // overrides config.CompilerPath if set
+}
+
+// errExitWithoutShutdown is returned by serve when the client sent exit
+// without asking for shutdown first.
+var errExitWithoutShutdown = errors.New("exit without shutdown")
+
+// lifecycle is how far a session is through the initialize, shutdown and
+// exit handshake. It is only read and written on the read loop.
+type lifecycle int
+
+const (
+    lifecycleStarting lifecycle = iota // waiting for initialize
+    lifecycleRunning
+    lifecycleShutdown // waiting for exit
+    lifecycleExited
+)
+
+// session serves a single client connection.
+//
+// Notifications are handled on the read loop in the order they arrive, so
+// document changes are always applied before any later request sees them.
+// Requests run on their own goroutine with a context that is cancelled by
+// $/cancelRequest. Diagnostics are compiled on a separate worker so a slow
+// compile never holds up the read loop.
+type session struct {
+    // also forwards warnings and errors to the client
+    logger *slog.Logger
+    level *slog.LevelVar
+    conn *rpc.Conn
+    router *router
+    // the last messages, for crash dumps
+    recent recentMessages
+    state *analysis.State
+
+    ctx context.Context
+    stop context.CancelFunc
+    requests sync.WaitGroup
+
+    lifecycle lifecycle
+    shutdownBeforeExit bool
+    // lifecycle reached exited, for the logger on other goroutines
+    exited *atomic.Bool
+
+    // from initialize, read-only afterwards
+    client lsp.ClientCapabilities
+    workspaceFolders []lsp.WorkspaceFolder
+
+    // process config with the client's layers applied, guarded by mu
+    baseConfig config.Config
+    initLayer config.Layer
+    settingsLayer config.Layer
+    config config.Config
+    compilerOverride analysis.Compiler
+
+    mu sync.Mutex
+    inflight map[rpc.ID]context.CancelFunc
+    trace string
+    // when the user was last told the compiler is broken, and whether
+    // that message is still open
+    alertShown time.Time
+    alertOpen bool
+
+    progressTokens atomic.Int64
+
+    // set by initialized, registrations wait for it
+    initialized bool
+    compilerMissing bool
+    // capabilities registered with the client, guarded by regMu
+    regMu sync.Mutex
+    registered map[string]bool
+
+    // held from checking a document's version to publishing diagnostics
+    // for it, so they can't be overtaken by a change or close; guards
+    // published
+    publishMu sync.Mutex
+    // the diagnostics the client was last sent for each uri
+    published map[string][]lsp.Diagnostic
+
+    // uris waiting for diagnostics and when they are due, guarded by mu
+    pending map[string]time.Time
+    // the uri being compiled and how to stop it, guarded by mu
+    compiling string
+    cancelCompile context.CancelFunc
+    wake chan struct{}
+    // closed once the client is gone, the worker then finishes what is
+    // pending if finishOnClose and closes drained
+    closing chan struct{}
+    drained chan struct{}
+    // answer every request and publish every queued diagnostic after the
+    // input ends, for replay; a live session stops at once
+    finishOnClose bool
+}
+
+func (srv *server) newSession(conn *rpc.Conn) *session {
+    ctx, stop := context.WithCancel(context.Background())
+    compiler := srv.compiler
+    if compiler == nil {
+        compiler = analysis.ExecCompiler{Path: srv.config.CompilerPath}
+    }
+
+    exited := new(atomic.Bool)
+    logger := slog.New(newClientHandler(srv.logger.Handler(), conn, exited))
+    s := &session{
+        logger: logger,
+        level: srv.level,
+        conn: conn,
+        state: analysis.NewState(logger, compiler),
+        ctx: ctx,
+        stop: stop,
+        exited: exited,
+        inflight: map[rpc.ID]context.CancelFunc{},
+        registered: map[string]bool{},
+        trace: lsp.TraceOff,
+        published: map[string][]lsp.Diagnostic{},
+        pending: map[string]time.Time{},
+        wake: make(chan struct{}, 1),
+        closing: make(chan struct{}),
+        drained: make(chan struct{}),
+        baseConfig: srv.config,
+        config: srv.config,
+        compilerOverride: srv.compiler,
+    }
+    s.router = s.routes()
+    conn.SetMaxMessageSize(srv.config.MaxMessageSize)
+    conn.OnError = func(err error) {
+        s.logger.Warn("Connection error", "err", err)
+    }
+    if srv.tracer != nil {
+        srv.tracer.attach(conn)
+    }
+    s.recent.attach(conn)
+    return s
+}
+
+// serve handles messages until the connection closes. Requests still
+// running are cancelled and compiles stopped, unless finishOnClose.
+func (s *session) serve() error {
+    go s.diagnosticsWorker()
+
+    err := s.conn.Run(s.dispatch)
+    if !s.finishOnClose || s.lifecycle == lifecycleExited {
+        // the client is gone, there is nobody left to answer
+        s.stop()
+    }
+    s.requests.Wait()
+    close(s.closing)
+    <-s.drained
+    s.stop()
+
+    if err == nil && s.lifecycle == lifecycleExited && !s.shutdownBeforeExit {
+        return errExitWithoutShutdown
+    }
+    return err
+}
+
+func (s *session) dispatch(msg *rpc.Message) {
+    if msg.IsRequest() {
+        s.logTrace(fmt.Sprintf("Received request '%s - (%s)'.", msg.Method, msg.ID), msg.Params)
+    } else {
+        s.logTrace(fmt.Sprintf("Received notification '%s'.", msg.Method), msg.Params)
+    }
+
+    if msg.Method == "exit" {
+        s.exit()
+        return
+    }
+    if !s.admit(msg) {
+        return
+    }
+
+    // initialize and shutdown change the lifecycle, which the read loop
+    // has to see before the next message
+    rt, ok := s.router.route(msg.Method)
+    if msg.IsNotification() || (ok && rt.onReadLoop) {
+        s.serveMessage(s.ctx, msg)
+        return
+    }
+
+    ctx, cancel := context.WithCancel(s.ctx)
+    s.mu.Lock()
+    s.inflight[*msg.ID] = cancel
+    s.mu.Unlock()
+
+    var params lsp.WorkDoneProgressParams
+    json.Unmarshal(msg.Params, &params)
+
+    s.requests.Add(1)
+    go func() {
+        defer s.requests.Done()
+        if params.WorkDoneToken != nil {
+            // the client asked to see progress for this request
+            p := s.startProgress(msg.Method, *params.WorkDoneToken)
+            defer p.end()
+            ctx = withProgress(ctx, p)
+        }
+        defer func() {
+            s.mu.Lock()
+            delete(s.inflight, *msg.ID)
+            s.mu.Unlock()
+            cancel()
+        }()
+        s.serveMessage(ctx, msg)
+    }()
+}
+
+// serveMessage runs msg through the router and answers it if it is a
+// request. The trace of a request follows its response; nothing may be
+// sent before the response to initialize.
+func (s *session) serveMessage(ctx context.Context, msg *rpc.Message) {
+    start := time.Now()
+    result, err := s.router.serve(ctx, msg)
+    if msg.IsRequest() {
+        s.reply(ctx, msg, result, err)
+        s.logTrace(fmt.Sprintf("Finished request '%s - (%s)' in %dms.",
+            msg.Method, msg.ID, time.Since(start).Milliseconds()), nil)
+    }
+}
+
+// admit enforces the lifecycle: nothing but initialize is served before
+// it, and nothing but exit after shutdown. Requests that are turned away
+// get an error reply, notifications are dropped.
+func (s *session) admit(msg *rpc.Message) bool {
+    var code lsp.ErrorCode
+    var message string
+
+    switch s.lifecycle {
+    case lifecycleStarting:
+        if msg.Method == "initialize" {
+            return true
+        }
+        code, message = lsp.ServerNotInitialized, "server not initialized"
+    case lifecycleRunning:
+        if msg.Method != "initialize" {
+            return true
+        }
+        code, message = lsp.InvalidRequest, "server already initialized"
+    case lifecycleShutdown:
+        code, message = lsp.InvalidRequest, "server is shutting down"
+    case lifecycleExited:
+        return false
+    }
+
+    if msg.IsRequest() {
+        s.writeResponse(lsp.NewErrorResponse(msg.ID, code, message))
+    } else {
+        s.logger.Info("Dropped notification", "method", msg.Method, "reason", message)
+    }
+    return false
+}
+
+func (s *session) exit() {
+    s.logger.Info("Exit requested")
+    s.shutdownBeforeExit = s.lifecycle == lifecycleShutdown
+    s.lifecycle = lifecycleExited
+    s.exited.Store(true)
+    s.conn.Close()
+}
+
+// logTrace sends a $/logTrace notification if the client asked for
+// tracing. The params are only included when the trace value is verbose.
+func (s *session) logTrace(message string, params json.RawMessage) {
+    s.mu.Lock()
+    trace := s.trace
+    s.mu.Unlock()
+
+    if trace != lsp.TraceMessages && trace != lsp.TraceVerbose {
+        return
+    }
+
+    notification := lsp.LogTraceNotification {
+        Notification: lsp.Notification {
+            RPC: "2.0",
+            Method: "$/logTrace",
+        },
+        Params: lsp.LogTraceParams {
+            Message: message,
+        },
+    }
+    if trace == lsp.TraceVerbose && len(params) > 0 {
+        notification.Params.Verbose = "Params: " + string(params)
+    }
+    s.writeResponse(notification)
+}
+
+// pullConfiguration asks the client for our settings section without
+// blocking the read loop, which has to deliver the answer.
+func (s *session) pullConfiguration() {
+    s.requests.Add(1)
+    go func() {
+        defer s.requests.Done()
+
+        params := lsp.ConfigurationParams{
+            Items: []lsp.ConfigurationItem{{Section: config.Section}},
+        }
+        var result []json.RawMessage
+        if err := s.conn.Call(s.ctx, "workspace/configuration", params, &result); err != nil {
+            s.callFailed("Could not pull configuration", err)
+            return
+        }
+        if len(result) > 0 {
+            s.setSettings(result[0])
+        }
+    }()
+}
+
+func (s *session) setSettings(settings json.RawMessage) {
+    layer, err := config.FromJSON(settings)
+    if err != nil {
+        s.logger.Warn("Invalid settings", "err", err)
+        return
+    }
+
+    s.mu.Lock()
+    s.settingsLayer = layer
+    s.mu.Unlock()
+    s.applyConfig()
+}
+
+// applyConfig resolves the layers again and puts changes into effect.
+func (s *session) applyConfig() {
+    s.mu.Lock()
+    old := s.config
+    s.config = s.baseConfig.With(s.initLayer).With(s.settingsLayer)
+    cfg := s.config
+    s.mu.Unlock()
+
+    if cfg.LogLevel != old.LogLevel {
+        if level, err := parseLevel(cfg.LogLevel); err != nil {
+            s.logger.Warn("Invalid log level", "err", err)
+        } else {
+            s.level.Set(level)
+        }
+    }
+    if cfg.Completion != old.Completion {
+        s.updateRegistrations()
+    }
+    if !cfg.CompileOnSave && old.CompileOnSave {
+        // what was published came from the quick checks
+        for _, uri := range s.state.DocumentURIs() {
+            s.queueDiagnostics(uri)
+        }
+    }
+    if cfg.CompilerPath != old.CompilerPath && s.compilerOverride == nil {
+        s.logger.Info("Compiler changed", "path", cfg.CompilerPath)
+        s.state.SetCompiler(analysis.ExecCompiler{Path: cfg.CompilerPath})
+        s.resetCompilerAlert()
+        for _, uri := range s.state.DocumentURIs() {
+            s.queueDiagnostics(uri)
+        }
+    }
+}
+
+// reply sends the result of a request, or the error, or RequestCancelled
+// if the request was cancelled while it was being handled.
+func (s *session) reply(ctx context.Context, msg *rpc.Message, result any, err error) {
+    // the client's token is done with once the request is answered
+    progressFrom(ctx).end()
+
+    var rerr *lsp.ResponseError
+    switch {
+    case ctx.Err() != nil:
+        rerr = &lsp.ResponseError{Code: lsp.RequestCancelled, Message: "request cancelled"}
+    case errors.As(err, &rerr):
+    case err != nil:
+        rerr = &lsp.ResponseError{Code: lsp.InternalError, Message: err.Error()}
+    }
+
+    if rerr != nil {
+        s.checkWrite(s.conn.ReplyError(msg.ID, rerr))
+        return
+    }
+    s.checkWrite(s.conn.Reply(msg.ID, result))
+}
+
+func (s *session) writeResponse(msg any) {
+    s.checkWrite(s.conn.Write(msg))
+}
+
+// callFailed logs a request to the client that failed. Calls cut short
+// because the session is ending are expected and only logged for debugging.
+func (s *session) callFailed(message string, err error) {
+    if errors.Is(err, rpc.ErrClosed) || errors.Is(err, rpc.ErrWriteFailed) ||
+        errors.Is(err, context.Canceled) {
+        s.logger.Debug(message, "err", err)
+        return
+    }
+    s.logger.Warn(message, "err", err)
+}
+
+func (s *session) checkWrite(err error) {
+    switch {
+    case errors.Is(err, rpc.ErrWriteFailed):
+        // the connection is gone, serve notices and stops
+        s.logger.Debug("Could not write message", "err", err)
+    case err != nil:
+        s.logger.Error("Could not encode message", "err", err)
+    }
+}
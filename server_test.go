@@ -0,0 +1,792 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sunny-lsp/analysis"
+	"sunny-lsp/config"
+	"sunny-lsp/lsp"
+	"sunny-lsp/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCompiler reports one error diagnostic per line of the file holding
+// "error", and counts how often it ran.
+type fakeCompiler struct {
+    mu sync.Mutex
+    runs int
+    // if set, every compile hangs until it is cancelled
+    hang bool
+    // if set, compiles of files holding "slow" wait for it to close,
+    // cancelled or not, like a compiler that doesn't stop in time
+    gate chan struct{}
+    // if set, returned for every file instead of the diagnostics
+    output string
+    // if set, every compile fails as if the compiler exited with 1
+    fail bool
+}
+
+func (c *fakeCompiler) Export(ctx context.Context, filename string) ([]byte, error) {
+    c.mu.Lock()
+    c.runs++
+    c.mu.Unlock()
+    if c.hang {
+        <-ctx.Done()
+        return nil, ctx.Err()
+    }
+
+    text, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    if c.gate != nil && strings.Contains(string(text), "slow") {
+        <-c.gate
+    }
+    c.mu.Lock()
+    fail := c.fail
+    c.mu.Unlock()
+    if fail {
+        return nil, &analysis.CompilerError{Kind: analysis.CompilerExited, Path: "fake", ExitCode: 1}
+    }
+    if c.output != "" {
+        return []byte(c.output), nil
+    }
+    diagnostics := []string{}
+    for i, line := range strings.Split(string(text), "\n") {
+        if strings.Contains(line, "error") {
+            diagnostics = append(diagnostics, fmt.Sprintf(`{"range":{"start":{"line":%d,"character":0},"end":{"line":%d,"character":5}},"severity":1,"source":"fake","message":"error"}`, i, i))
+        }
+    }
+    return []byte(`{"symbols":[],"ast":[],"diagnostics":[` + strings.Join(diagnostics, ",") + `]}`), nil
+}
+
+func (c *fakeCompiler) count() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.runs
+}
+
+// testClient drives a session over in-memory pipes, like replay does.
+type testClient struct {
+    t *testing.T
+    in *io.PipeWriter
+    messages chan *rpc.Message
+    served chan error
+}
+
+// startSession serves a session over pipes. setup runs before it serves,
+// e.g. to add routes.
+func startSession(t *testing.T, compiler *fakeCompiler, cfg config.Config, setup ...func(*session)) *testClient {
+    clientOut, serverIn := io.Pipe()
+    serverOut, clientIn := io.Pipe()
+
+    srv := &server{
+        logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+        level: new(slog.LevelVar),
+        config: cfg,
+        compiler: compiler,
+    }
+    c := &testClient{
+        t: t,
+        in: serverIn,
+        messages: make(chan *rpc.Message, 100),
+        served: make(chan error, 1),
+    }
+    s := srv.newSession(rpc.NewConn(clientOut, clientIn))
+    for _, fn := range setup {
+        fn(s)
+    }
+    go func() {
+        err := s.serve()
+        clientIn.Close()
+        c.served <- err
+    }()
+    go func() {
+        defer close(c.messages)
+        reader := rpc.NewReader(serverOut)
+        for {
+            content, err := reader.ReadMessage()
+            if err != nil {
+                return
+            }
+            var msg rpc.Message
+            if err := json.Unmarshal(content, &msg); err != nil {
+                t.Errorf("Server sent invalid JSON: %s", content)
+                return
+            }
+            msg.Content = content
+            c.messages <- &msg
+        }
+    }()
+    t.Cleanup(func() {
+        serverIn.Close()
+        serverOut.Close()
+    })
+    return c
+}
+
+func testConfig() config.Config {
+    cfg := config.Default()
+    cfg.LogFile = "none"
+    cfg.DiagnosticsDelay = 50
+    return cfg
+}
+
+func (c *testClient) send(format string, args ...any) {
+    content := fmt.Sprintf(format, args...)
+    fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+// next returns the next message the server sends with the method, or
+// the response to the id if method is "".
+func (c *testClient) next(method string, id rpc.ID) *rpc.Message {
+    c.t.Helper()
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case msg, ok := <-c.messages:
+            if !ok {
+                c.t.Fatalf("Expected %q (%s), Actual connection closed", method, id)
+            }
+            if method != "" && msg.Method == method {
+                return msg
+            }
+            if method == "" && msg.IsResponse() && msg.ID != nil && *msg.ID == id {
+                return msg
+            }
+        case <-timeout:
+            c.t.Fatalf("Expected %q (%s), Actual nothing within 5s", method, id)
+        }
+    }
+}
+
+// reply answers a request the server sent with result, a JSON value.
+func (c *testClient) reply(msg *rpc.Message, result string) {
+    c.send(`{"jsonrpc":"2.0","id":%s,"result":%s}`, msg.ID, result)
+}
+
+// until returns every message the server sends up to and including the
+// response to id.
+func (c *testClient) until(id rpc.ID) []*rpc.Message {
+    c.t.Helper()
+    var messages []*rpc.Message
+    timeout := time.After(5 * time.Second)
+    for {
+        select {
+        case msg, ok := <-c.messages:
+            if !ok {
+                c.t.Fatalf("Expected the response to %s, Actual connection closed", id)
+            }
+            messages = append(messages, msg)
+            if msg.IsResponse() && msg.ID != nil && *msg.ID == id {
+                return messages
+            }
+        case <-timeout:
+            c.t.Fatalf("Expected the response to %s, Actual nothing within 5s", id)
+        }
+    }
+}
+
+// quiet fails if the server sends any of methods within d.
+func (c *testClient) quiet(d time.Duration, methods ...string) {
+    c.t.Helper()
+    timeout := time.After(d)
+    for {
+        select {
+        case msg, ok := <-c.messages:
+            if !ok {
+                return
+            }
+            if slices.Contains(methods, msg.Method) {
+                c.t.Fatalf("Expected no %s, Actual %s", msg.Method, msg.Content)
+            }
+        case <-timeout:
+            return
+        }
+    }
+}
+
+func (c *testClient) initialize() {
+    c.t.Helper()
+    c.initializeWith(`{}`)
+}
+
+// initializeWith initializes a client with the capabilities, a JSON
+// object.
+func (c *testClient) initializeWith(capabilities string) {
+    c.t.Helper()
+    c.send(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":%s}}`, capabilities)
+    if msg := c.next("", rpc.NumberID(1)); msg.Error != nil {
+        c.t.Fatalf("Expected initialize to succeed, Actual %v", msg.Error)
+    }
+    c.send(`{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+}
+
+// exit ends the session the way a client should and returns what serve
+// returned.
+func (c *testClient) exit() error {
+    c.t.Helper()
+    c.send(`{"jsonrpc":"2.0","id":999,"method":"shutdown"}`)
+    c.next("", rpc.NumberID(999))
+    c.send(`{"jsonrpc":"2.0","method":"exit"}`)
+    return c.wait()
+}
+
+func (c *testClient) wait() error {
+    c.t.Helper()
+    select {
+    case err := <-c.served:
+        return err
+    case <-time.After(5 * time.Second):
+        c.t.Fatalf("Expected the session to end")
+        return nil
+    }
+}
+
+// Run with -race: the diagnostics worker starts before initialize sets
+// the client capabilities. Many sessions make a bad interleaving likely.
+func TestInitialize(t *testing.T) {
+    for i := 0; i < 50; i++ {
+        t.Run(fmt.Sprint(i), func(t *testing.T) {
+            t.Parallel()
+            c := startSession(t, &fakeCompiler{}, testConfig())
+            c.initialize()
+            if err := c.exit(); err != nil {
+                t.Fatalf("Expected a clean exit, Actual %v", err)
+            }
+        })
+    }
+}
+
+func TestStringIDs(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.send(`{"jsonrpc":"2.0","id":"init","method":"initialize","params":{"capabilities":{}}}`)
+    if msg := c.next("", rpc.StringID("init")); msg.Error != nil {
+        t.Fatalf("Expected initialize to succeed, Actual %v", msg.Error)
+    }
+    c.send(`{"jsonrpc":"2.0","id":"1","method":"textDocument/hover","params":{"textDocument":{"uri":"file:///missing.sunny"},"position":{"line":0,"character":0}}}`)
+    if msg := c.next("", rpc.StringID("1")); msg.Error != nil {
+        t.Fatalf("Expected a hover result, Actual %v", msg.Error)
+    }
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+func TestLifecycle(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.send(`{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    if msg := c.next("", rpc.NumberID(1)); msg.Error == nil || msg.Error.Code != -32002 {
+        t.Fatalf("Expected ServerNotInitialized, Actual %s", msg.Content)
+    }
+
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"initialize","params":{"capabilities":{}}}`)
+    if msg := c.next("", rpc.NumberID(2)); msg.Error != nil {
+        t.Fatalf("Expected initialize to succeed, Actual %v", msg.Error)
+    }
+    c.send(`{"jsonrpc":"2.0","id":3,"method":"initialize","params":{"capabilities":{}}}`)
+    if msg := c.next("", rpc.NumberID(3)); msg.Error == nil || msg.Error.Code != -32600 {
+        t.Fatalf("Expected InvalidRequest for a second initialize, Actual %s", msg.Content)
+    }
+
+    c.send(`{"jsonrpc":"2.0","id":4,"method":"shutdown"}`)
+    if msg := c.next("", rpc.NumberID(4)); msg.Error != nil {
+        t.Fatalf("Expected shutdown to succeed, Actual %v", msg.Error)
+    }
+    c.send(`{"jsonrpc":"2.0","id":5,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    if msg := c.next("", rpc.NumberID(5)); msg.Error == nil || msg.Error.Code != -32600 {
+        t.Fatalf("Expected InvalidRequest after shutdown, Actual %s", msg.Content)
+    }
+
+    c.send(`{"jsonrpc":"2.0","method":"exit"}`)
+    if err := c.wait(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.initialize()
+    c.send(`{"jsonrpc":"2.0","method":"exit"}`)
+    if err := c.wait(); err != errExitWithoutShutdown {
+        t.Fatalf("Expected errExitWithoutShutdown, Actual %v", err)
+    }
+}
+
+// publishedVersion decodes a textDocument/publishDiagnostics notification.
+func publishedVersion(t *testing.T, msg *rpc.Message) (int, int) {
+    t.Helper()
+    var params struct {
+        Version *int `json:"version"`
+        Diagnostics []json.RawMessage `json:"diagnostics"`
+    }
+    if err := json.Unmarshal(msg.Params, &params); err != nil || params.Version == nil {
+        t.Fatalf("Expected versioned diagnostics, Actual %s", msg.Content)
+    }
+    return *params.Version, len(params.Diagnostics)
+}
+
+func TestDiagnosticsBurst(t *testing.T) {
+    compiler := &fakeCompiler{}
+    cfg := testConfig()
+    cfg.DiagnosticsDelay = 200
+    c := startSession(t, compiler, cfg)
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"ok"}}}`)
+    if version, _ := publishedVersion(t, c.next("textDocument/publishDiagnostics", rpc.ID{})); version != 1 {
+        t.Fatalf("Expected version 1, Actual %d", version)
+    }
+
+    for version := 2; version <= 10; version++ {
+        c.send(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.sunny","version":%d},"contentChanges":[{"text":"error %d"}]}}`, version, version)
+    }
+    version, count := publishedVersion(t, c.next("textDocument/publishDiagnostics", rpc.ID{}))
+    if version != 10 || count != 1 {
+        t.Fatalf("Expected one diagnostic for version 10, Actual %d for version %d", count, version)
+    }
+    c.quiet(400 * time.Millisecond, "textDocument/publishDiagnostics")
+    if runs := compiler.count(); runs != 2 {
+        t.Fatalf("Expected 2 compiles, Actual %d", runs)
+    }
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+func TestDiagnosticsUnchanged(t *testing.T) {
+    compiler := &fakeCompiler{}
+    c := startSession(t, compiler, testConfig())
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"error"}}}`)
+    if _, count := publishedVersion(t, c.next("textDocument/publishDiagnostics", rpc.ID{})); count != 1 {
+        t.Fatalf("Expected one diagnostic, Actual %d", count)
+    }
+
+    // the same error, on the same line
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.sunny","version":2},"contentChanges":[{"text":"error\nok"}]}}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for compiler.count() < 2 {
+        if time.Now().After(deadline) {
+            t.Fatal("Expected the change to be compiled")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.quiet(200 * time.Millisecond, "textDocument/publishDiagnostics")
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// A client that goes away without exit must not leave the process behind,
+// even while the compiler hangs.
+func TestInputClosedStopsCompile(t *testing.T) {
+    compiler := &fakeCompiler{hang: true}
+    cfg := testConfig()
+    cfg.DiagnosticsDelay = 0
+    c := startSession(t, compiler, cfg)
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"ok"}}}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for compiler.count() < 1 {
+        if time.Now().After(deadline) {
+            t.Fatal("Expected the document to be compiled")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    c.in.Close()
+    if err := c.wait(); err != nil {
+        t.Fatalf("Expected serve to return, Actual %v", err)
+    }
+}
+
+func TestClientProgressToken(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0},"workDoneToken":"tok"}}`)
+    var kinds []string
+    for _, msg := range c.until(rpc.NumberID(2)) {
+        if msg.Method != "$/progress" {
+            continue
+        }
+        var params struct {
+            Token string `json:"token"`
+            Value struct {
+                Kind string `json:"kind"`
+            } `json:"value"`
+        }
+        if err := json.Unmarshal(msg.Params, &params); err != nil || params.Token != "tok" {
+            t.Fatalf("Expected progress for the client's token, Actual %s", msg.Content)
+        }
+        kinds = append(kinds, params.Value.Kind)
+    }
+    if strings.Join(kinds, ",") != "begin,end" {
+        t.Fatalf("Expected begin and end before the response, Actual %v", kinds)
+    }
+
+    // some clients send null for no token
+    c.send(`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0},"workDoneToken":null}}`)
+    for _, msg := range c.until(rpc.NumberID(3)) {
+        if msg.Method == "$/progress" {
+            t.Fatalf("Expected no progress for a null token, Actual %s", msg.Content)
+        }
+    }
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// Nothing may precede the response to initialize, and a request's trace
+// follows its response.
+func TestTraceAfterResponse(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.send(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{},"trace":"messages"}}`)
+    if messages := c.until(rpc.NumberID(1)); len(messages) != 1 {
+        t.Fatalf("Expected only the initialize response, Actual %s first", messages[0].Content)
+    }
+    if msg := c.next("$/logTrace", rpc.ID{}); !strings.Contains(string(msg.Params), "Finished request 'initialize") {
+        t.Fatalf("Expected the initialize trace, Actual %s", msg.Content)
+    }
+    c.send(`{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    for _, msg := range c.until(rpc.NumberID(2)) {
+        if strings.Contains(string(msg.Params), "Finished request 'textDocument/hover") {
+            t.Fatalf("Expected the trace after the response, Actual %s first", msg.Content)
+        }
+    }
+    if msg := c.next("$/logTrace", rpc.ID{}); !strings.Contains(string(msg.Params), "Finished request 'textDocument/hover") {
+        t.Fatalf("Expected the hover trace, Actual %s", msg.Content)
+    }
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// A panicking handler is answered with InternalError and dumped with what
+// led up to it, and the session keeps serving.
+func TestHandlerPanic(t *testing.T) {
+    dir := t.TempDir()
+    cfg := testConfig()
+    cfg.LogFile = filepath.Join(dir, "sunny-lsp.log")
+    c := startSession(t, &fakeCompiler{}, cfg, func(s *session) {
+        handle(s.router, "test/panic", func(ctx context.Context, params lsp.TextDocumentPositionParam) (any, error) {
+            var symbols []int
+            return symbols[params.Position.Line], nil
+        })
+    })
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"func main() {}"}}}`)
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"test/panic","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":3,"character":0}}}`)
+    if msg := c.next("", rpc.NumberID(2)); msg.Error == nil || msg.Error.Code != -32603 {
+        t.Fatalf("Expected InternalError, Actual %s", msg.Content)
+    }
+
+    c.send(`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    if msg := c.next("", rpc.NumberID(3)); msg.Error != nil {
+        t.Fatalf("Expected the session to keep serving, Actual %v", msg.Error)
+    }
+
+    dumps, _ := filepath.Glob(filepath.Join(dir, "sunny-lsp-crash-*.json"))
+    if len(dumps) != 1 {
+        t.Fatalf("Expected one crash dump, Actual %v", dumps)
+    }
+    data, err := os.ReadFile(dumps[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    var dump crashDump
+    if err := json.Unmarshal(data, &dump); err != nil {
+        t.Fatal(err)
+    }
+    if dump.Method != "test/panic" || !strings.Contains(dump.Panic, "index out of range") {
+        t.Fatalf("Expected the panic of test/panic, Actual %s: %s", dump.Method, dump.Panic)
+    }
+    if dump.Documents["file:///a.sunny"] != "func main() {}" {
+        t.Fatalf("Expected the document text, Actual %v", dump.Documents)
+    }
+    found := false
+    for _, entry := range dump.Messages {
+        var msg rpc.Message
+        json.Unmarshal(entry.Message, &msg)
+        found = found || msg.Method == "test/panic"
+    }
+    if !found {
+        t.Fatalf("Expected the request among the recent messages, Actual %d messages", len(dump.Messages))
+    }
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// Diagnostics of a version that was changed while it compiled are never
+// published over those of the newer one.
+func TestStaleDiagnosticsDropped(t *testing.T) {
+    compiler := &fakeCompiler{gate: make(chan struct{})}
+    cfg := testConfig()
+    cfg.DiagnosticsDelay = 0
+    var s *session
+    c := startSession(t, compiler, cfg, func(session *session) {
+        s = session
+    })
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"slow error"}}}`)
+    deadline := time.Now().Add(5 * time.Second)
+    for compiler.count() < 1 {
+        if time.Now().After(deadline) {
+            t.Fatal("Expected version 1 to be compiled")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.sunny","version":2},"contentChanges":[{"text":"ok"}]}}`)
+    // the read loop has applied the change once it answers a later request
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    c.next("", rpc.NumberID(2))
+    close(compiler.gate)
+
+    version, count := publishedVersion(t, c.next("textDocument/publishDiagnostics", rpc.ID{}))
+    if version != 2 || count != 0 {
+        t.Fatalf("Expected no diagnostics for version 2, Actual %d for version %d", count, version)
+    }
+
+    // a compile of version 1 that got past cancellation
+    s.publishVersion("file:///a.sunny", 1, []lsp.Diagnostic{{Message: "error"}})
+    c.quiet(200 * time.Millisecond, "textDocument/publishDiagnostics")
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// symbolsExport is main declaring a local x, for
+// "func main() {\n    mut x := 1\n}".
+const symbolsExport = `{
+    "symbols": [
+        {"name":"main","type":"func() u0","reachable_scopes":[0,1],"range":{"start":{"line":0,"character":5},"end":{"line":0,"character":9}}},
+        {"name":"x","type":"i32","reachable_scopes":[1],"range":{"start":{"line":1,"character":8},"end":{"line":1,"character":9}}}
+    ],
+    "ast": [
+        {"name":"main","scope":0,"range":{"start":{"line":0,"character":5},"end":{"line":0,"character":9}}},
+        {"name":"x","scope":1,"range":{"start":{"line":1,"character":8},"end":{"line":1,"character":9}}}
+    ],
+    "diagnostics": []
+}`
+
+// Hover, completion and symbols follow what the client said it can take.
+func TestClientCapabilities(t *testing.T) {
+    tests := []struct {
+        name string
+        capabilities string
+        hoverKind string
+        hoverValue string
+        snippets bool
+        hierarchical bool
+    }{
+        {
+            name: "rich",
+            capabilities: `{"textDocument":{
+                "hover":{"contentFormat":["markdown","plaintext"]},
+                "completion":{"completionItem":{"snippetSupport":true}},
+                "documentSymbol":{"hierarchicalDocumentSymbolSupport":true}}}`,
+            hoverKind: "markdown",
+            hoverValue: "**x** : *i32*",
+            snippets: true,
+            hierarchical: true,
+        },
+        {
+            name: "plain",
+            capabilities: `{}`,
+            hoverKind: "plaintext",
+            hoverValue: "x : i32",
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            c := startSession(t, &fakeCompiler{output: symbolsExport}, testConfig())
+            c.initializeWith(test.capabilities)
+            c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"func main() {\n    mut x := 1\n}"}}}`)
+
+            c.send(`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":1,"character":8}}}`)
+            var hover struct {
+                Contents struct {
+                    Kind string `json:"kind"`
+                    Value string `json:"value"`
+                } `json:"contents"`
+            }
+            json.Unmarshal(c.next("", rpc.NumberID(2)).Result, &hover)
+            if hover.Contents.Kind != test.hoverKind || !strings.HasPrefix(hover.Contents.Value, test.hoverValue) {
+                t.Fatalf("Expected %s hover %q, Actual %s %q", test.hoverKind, test.hoverValue, hover.Contents.Kind, hover.Contents.Value)
+            }
+
+            c.send(`{"jsonrpc":"2.0","id":3,"method":"textDocument/completion","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+            var items []lsp.CompletionItem
+            json.Unmarshal(c.next("", rpc.NumberID(3)).Result, &items)
+            snippets := false
+            for _, item := range items {
+                snippets = snippets || item.InsertTextFormat == lsp.InsertTextFormatSnippet
+            }
+            if len(items) == 0 || snippets != test.snippets {
+                t.Fatalf("Expected %d items with snippets %t, Actual snippets %t", len(items), test.snippets, snippets)
+            }
+
+            c.send(`{"jsonrpc":"2.0","id":4,"method":"textDocument/documentSymbol","params":{"textDocument":{"uri":"file:///a.sunny"}}}`)
+            result := c.next("", rpc.NumberID(4)).Result
+            if test.hierarchical {
+                var symbols []lsp.DocumentSymbol
+                json.Unmarshal(result, &symbols)
+                if len(symbols) != 1 || symbols[0].Name != "main" || len(symbols[0].Children) != 1 || symbols[0].Children[0].Name != "x" {
+                    t.Fatalf("Expected x nested under main, Actual %s", result)
+                }
+            } else {
+                var symbols []lsp.SymbolInformation
+                json.Unmarshal(result, &symbols)
+                if len(symbols) != 2 || symbols[1].Name != "x" || symbols[1].ContainerName != "main" {
+                    t.Fatalf("Expected a flat list with x in main, Actual %s", result)
+                }
+            }
+
+            if err := c.exit(); err != nil {
+                t.Fatalf("Expected a clean exit, Actual %v", err)
+            }
+        })
+    }
+}
+
+func (c *fakeCompiler) setFailing(fail bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.fail = fail
+}
+
+// waitRuns waits until the compiler has run n times.
+func (c *fakeCompiler) waitRuns(t *testing.T, n int) {
+    t.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for c.count() < n {
+        if time.Now().After(deadline) {
+            t.Fatalf("Expected %d compiles, Actual %d", n, c.count())
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// A broken compiler is reported at once, and again straight away when the
+// user asks to retry, but not after every edit.
+func TestCompilerAlertRateLimited(t *testing.T) {
+    compiler := &fakeCompiler{fail: true}
+    cfg := testConfig()
+    cfg.DiagnosticsDelay = 0
+    c := startSession(t, compiler, cfg)
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"ok"}}}`)
+    alert := c.next("window/showMessageRequest", rpc.ID{})
+    if !strings.Contains(string(alert.Params), "compiler fake exited with status 1") {
+        t.Fatalf("Expected the compiler error, Actual %s", alert.Content)
+    }
+    c.reply(alert, `{"title":"Retry"}`)
+    c.reply(c.next("window/showMessageRequest", rpc.ID{}), `null`)
+    compiler.waitRuns(t, 2)
+
+    // a successful compile in between doesn't lift the limit
+    compiler.setFailing(false)
+    for version := 2; version <= 4; version++ {
+        c.send(`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.sunny","version":%d},"contentChanges":[{"text":"ok %d"}]}}`, version, version)
+        compiler.waitRuns(t, version + 1)
+        compiler.setFailing(true)
+    }
+    c.quiet(200 * time.Millisecond, "window/showMessageRequest", "window/logMessage")
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// registrations returns the methods a client/registerCapability or
+// client/unregisterCapability request is about.
+func registrations(t *testing.T, msg *rpc.Message) []string {
+    t.Helper()
+    var params struct {
+        Registrations []lsp.Registration `json:"registrations"`
+        Unregisterations []lsp.Unregistration `json:"unregisterations"`
+    }
+    if err := json.Unmarshal(msg.Params, &params); err != nil {
+        t.Fatal(err)
+    }
+    var methods []string
+    for _, r := range params.Registrations {
+        methods = append(methods, r.Method)
+    }
+    for _, u := range params.Unregisterations {
+        methods = append(methods, u.Method)
+    }
+    return methods
+}
+
+// Completion is registered while the settings turn it on.
+func TestCompletionRegistration(t *testing.T) {
+    c := startSession(t, &fakeCompiler{}, testConfig())
+    c.initializeWith(`{"textDocument":{"completion":{"dynamicRegistration":true}}}`)
+
+    register := c.next("client/registerCapability", rpc.ID{})
+    if methods := registrations(t, register); !slices.Equal(methods, []string{"textDocument/completion"}) {
+        t.Fatalf("Expected completion to be registered, Actual %v", methods)
+    }
+    c.reply(register, `null`)
+
+    c.send(`{"jsonrpc":"2.0","method":"workspace/didChangeConfiguration","params":{"settings":{"sunny":{"completion":false}}}}`)
+    unregister := c.next("client/unregisterCapability", rpc.ID{})
+    if methods := registrations(t, unregister); !slices.Equal(methods, []string{"textDocument/completion"}) {
+        t.Fatalf("Expected completion to be unregistered, Actual %v", methods)
+    }
+    c.reply(unregister, `null`)
+
+    c.send(`{"jsonrpc":"2.0","method":"workspace/didChangeConfiguration","params":{"settings":{"sunny":{"completion":true}}}}`)
+    register = c.next("client/registerCapability", rpc.ID{})
+    if methods := registrations(t, register); !slices.Equal(methods, []string{"textDocument/completion"}) {
+        t.Fatalf("Expected completion to be registered again, Actual %v", methods)
+    }
+    c.reply(register, `null`)
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
+
+// The configured limit applies to what the client sends.
+func TestMaxMessageSize(t *testing.T) {
+    cfg := testConfig()
+    cfg.MaxMessageSize = 1024
+    c := startSession(t, &fakeCompiler{}, cfg)
+    c.initialize()
+
+    c.send(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.sunny","languageId":"sunny","version":1,"text":"%s"}}}`, strings.Repeat("a", 1024))
+    c.send(`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.sunny"},"position":{"line":0,"character":0}}}`)
+    if msg := c.next("", rpc.NumberID(2)); !strings.Contains(string(msg.Result), "document not found") {
+        t.Fatalf("Expected the large didOpen to be dropped, Actual %s", msg.Content)
+    }
+
+    if err := c.exit(); err != nil {
+        t.Fatalf("Expected a clean exit, Actual %v", err)
+    }
+}
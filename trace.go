@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sunny-lsp/rpc"
+	"sync"
+	"time"
+)
+
+// traceEntry is one line of a trace file.
+type traceEntry struct {
+    Time time.Time `json:"time"`
+    Session int `json:"session"`
+    Direction rpc.Direction `json:"direction"`
+    Message json.RawMessage `json:"message"`
+}
+
+// traceRecorder appends every protocol message of every session to a
+// JSONL file.
+type traceRecorder struct {
+    mu sync.Mutex
+    file *os.File
+    encoder *json.Encoder
+    sessions int
+}
+
+func newTraceRecorder(filename string) (*traceRecorder, error) {
+    file, err := os.OpenFile(filename, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
+    if err != nil {
+        return nil, err
+    }
+    return &traceRecorder{
+        file: file,
+        encoder: json.NewEncoder(file),
+    }, nil
+}
+
+// attach records the messages of conn under a new session number.
+func (t *traceRecorder) attach(conn *rpc.Conn) {
+    t.mu.Lock()
+    t.sessions++
+    session := t.sessions
+    t.mu.Unlock()
+
+    conn.Trace = func(dir rpc.Direction, content []byte) {
+        t.record(session, dir, content)
+    }
+}
+
+func (t *traceRecorder) record(session int, dir rpc.Direction, content []byte) {
+    entry := traceEntry{
+        Time: time.Now(),
+        Session: session,
+        Direction: dir,
+        Message: content,
+    }
+    if !json.Valid(content) {
+        // keep the line parseable even if the client sent garbage
+        entry.Message, _ = json.Marshal(string(content))
+    }
+
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.encoder.Encode(entry)
+}
+
+func (t *traceRecorder) Close() error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.file.Close()
+}
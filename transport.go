@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sunny-lsp/rpc"
+	"sync"
+	"syscall"
+)
+
+// serveStdio runs a single session over stdin and stdout, which is how
+// editors normally launch the server.
+func (srv *server) serveStdio() error {
+    // a closed stdout should fail the write, not kill the process
+    signal.Ignore(syscall.SIGPIPE)
+
+    conn := rpc.NewConn(os.Stdin, os.Stdout)
+    if err := srv.newSession(conn).serve(); err != nil {
+        if errors.Is(err, rpc.ErrWriteFailed) {
+            srv.logger.Info("Output closed", "err", err)
+            return nil
+        }
+        return err
+    }
+    srv.logger.Info("Input closed")
+    return nil
+}
+
+// parseListenAddr splits an address such as tcp://127.0.0.1:9257 or
+// unix:///tmp/sunny.sock into its network and address.
+func parseListenAddr(addr string) (string, string, error) {
+    network, address, found := strings.Cut(addr, "://")
+    if !found {
+        return "", "", fmt.Errorf("listen address %q has no scheme, expected tcp:// or unix://", addr)
+    }
+    switch network {
+    case "tcp", "tcp4", "tcp6", "unix":
+        return network, address, nil
+    }
+    return "", "", fmt.Errorf("unsupported listen scheme %q", network)
+}
+
+// serveListener accepts connections and gives each its own session. With
+// multi set the process keeps accepting until it is interrupted, otherwise
+// it exits once the first client disconnects.
+func (srv *server) serveListener(network, address string, multi bool) error {
+    logger := srv.logger
+
+    if network == "unix" {
+        if err := removeStaleSocket(address); err != nil {
+            return err
+        }
+    }
+
+    listener, err := net.Listen(network, address)
+    if err != nil {
+        return err
+    }
+    logger.Info("Listening", "addr", network+"://"+listener.Addr().String())
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    go func() {
+        <-ctx.Done()
+        listener.Close()
+    }()
+
+    var sessions sync.WaitGroup
+    defer sessions.Wait()
+
+    for {
+        c, err := listener.Accept()
+        if err != nil {
+            if errors.Is(err, net.ErrClosed) {
+                return nil
+            }
+            return err
+        }
+        logger.Info("Accepted connection", "remote", c.RemoteAddr())
+
+        if !multi {
+            // another server checking whether the socket is live connects
+            // and hangs up; that is not the client we are waiting for
+            in := bufio.NewReader(c)
+            stop := context.AfterFunc(ctx, func() { c.Close() })
+            _, err := in.Peek(1)
+            stop()
+            if ctx.Err() != nil {
+                return nil
+            }
+            if err != nil {
+                logger.Info("Connection closed before any message", "remote", c.RemoteAddr())
+                c.Close()
+                continue
+            }
+            listener.Close()
+            return srv.serveConn(ctx, c, in)
+        }
+
+        sessions.Add(1)
+        go func() {
+            defer sessions.Done()
+            if err := srv.serveConn(ctx, c, c); err != nil {
+                logger.Error("Connection failed", "remote", c.RemoteAddr(), "err", err)
+            }
+        }()
+    }
+}
+
+// removeStaleSocket removes a socket left behind by a crashed server,
+// which would make Listen fail. A socket that still accepts connections
+// belongs to a live server and is left alone.
+func removeStaleSocket(address string) error {
+    info, err := os.Stat(address)
+    if err != nil || info.Mode()&os.ModeSocket == 0 {
+        // Listen reports what is wrong with the path
+        return nil
+    }
+    c, err := net.Dial("unix", address)
+    if err == nil {
+        c.Close()
+        return fmt.Errorf("another server is listening on %s", address)
+    }
+    if !errors.Is(err, syscall.ECONNREFUSED) {
+        return err
+    }
+    return os.Remove(address)
+}
+
+// serveConn runs a session on c, reading from in, which is c or reads
+// from it. The connection is closed early if ctx is done.
+func (srv *server) serveConn(ctx context.Context, c net.Conn, in io.Reader) error {
+    defer c.Close()
+    stop := context.AfterFunc(ctx, func() { c.Close() })
+    defer stop()
+
+    err := srv.newSession(rpc.NewConn(in, c)).serve()
+    srv.logger.Info("Connection closed", "remote", c.RemoteAddr())
+    return err
+}
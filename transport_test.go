@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sunny-lsp/rpc"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+    address := filepath.Join(t.TempDir(), "sunny.sock")
+    listener, err := net.Listen("unix", address)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if err := removeStaleSocket(address); err == nil || !strings.Contains(err.Error(), "another server") {
+        t.Fatalf("Expected a live socket to be kept, Actual %v", err)
+    }
+    if _, err := os.Stat(address); err != nil {
+        t.Fatalf("Expected the live socket to stay, Actual %v", err)
+    }
+
+    // leave the file behind, as a crashed server would
+    listener.(*net.UnixListener).SetUnlinkOnClose(false)
+    listener.Close()
+    if err := removeStaleSocket(address); err != nil {
+        t.Fatalf("Expected a stale socket to be removed, Actual %v", err)
+    }
+    if _, err := os.Stat(address); !os.IsNotExist(err) {
+        t.Fatalf("Expected the stale socket to be gone, Actual %v", err)
+    }
+}
+
+// The check another server makes must not use up a single-client server.
+func TestSocketProbeKeepsServer(t *testing.T) {
+    address := filepath.Join(t.TempDir(), "sunny.sock")
+    srv := &server{
+        logger: slog.New(slog.DiscardHandler),
+        level: new(slog.LevelVar),
+        config: testConfig(),
+        compiler: &fakeCompiler{},
+    }
+    served := make(chan error, 1)
+    go func() {
+        served <- srv.serveListener("unix", address, false)
+    }()
+    for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+        if _, err := os.Stat(address); err == nil {
+            break
+        }
+        if time.Since(start) > 5 * time.Second {
+            t.Fatal("Expected the server to listen")
+        }
+    }
+
+    if err := removeStaleSocket(address); err == nil {
+        t.Fatal("Expected the socket to be in use")
+    }
+
+    c, err := net.Dial("unix", address)
+    if err != nil {
+        t.Fatalf("Expected the server to still accept, Actual %v", err)
+    }
+    request := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{}}}`
+    fmt.Fprintf(c, "Content-Length: %d\r\n\r\n%s", len(request), request)
+    content, err := rpc.NewReader(c).ReadMessage()
+    if err != nil || !strings.Contains(string(content), `"id":1,"result"`) {
+        t.Fatalf("Expected the initialize result, Actual %s %v", content, err)
+    }
+    c.Close()
+    <-served
+}